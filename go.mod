@@ -4,11 +4,15 @@ require (
 	github.com/hashicorp/go-getter/v2 v2.1.0
 	github.com/hashicorp/hcl/v2 v2.13.0
 	github.com/hashicorp/packer-plugin-sdk v0.3.1
+	github.com/klauspost/compress v1.15.9
+	github.com/klauspost/pgzip v1.2.5
 	github.com/mattn/go-tty v0.0.4
 	github.com/mitchellh/mapstructure v1.4.1
+	github.com/pierrec/lz4 v2.6.1+incompatible
 	github.com/rekby/mbr v0.0.0-20151216101307-8c28b6465703
 	github.com/ulikunitz/xz v0.5.10
 	github.com/zclconf/go-cty v1.10.0
+	golang.org/x/sys v0.0.0-20211019181941-9d821ace8654
 	gopkg.in/h2non/filetype.v1 v1.0.5
 )
 
@@ -79,7 +83,6 @@ require (
 	github.com/mitchellh/reflectwalk v1.0.1 // indirect
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d // indirect
 	github.com/packer-community/winrmcp v0.0.0-20180921211025-c76d91c1e7db // indirect
-	github.com/pierrec/lz4 v2.6.1+incompatible // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pkg/sftp v1.13.2 // indirect
 	github.com/posener/complete v1.2.3 // indirect
@@ -91,7 +94,6 @@ require (
 	golang.org/x/mod v0.6.0-dev.0.20220106191415-9b9b3d81d5e3 // indirect
 	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2 // indirect
 	golang.org/x/oauth2 v0.0.0-20210819190943-2bc19b11175f // indirect
-	golang.org/x/sys v0.0.0-20211019181941-9d821ace8654 // indirect
 	golang.org/x/term v0.0.0-20210615171337-6886f2dfbf5b // indirect
 	golang.org/x/text v0.3.7 // indirect
 	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac // indirect
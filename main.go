@@ -11,6 +11,7 @@ func main() {
 	pps := plugin.NewSet()
 	pps.RegisterBuilder(plugin.DEFAULT_NAME, builder.NewBuilder())
 	pps.RegisterPostProcessor(plugin.DEFAULT_NAME, postprocessor.NewFlasher())
+	pps.RegisterPostProcessor("convert", postprocessor.NewConverter())
 	pps.SetVersion(version.PluginVersion)
 	err := pps.Run()
 	if err != nil {
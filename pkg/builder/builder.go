@@ -23,6 +23,7 @@ import (
 	"github.com/solo-io/packer-plugin-arm-image/pkg/builder/embed"
 	"github.com/solo-io/packer-plugin-arm-image/pkg/image"
 	"github.com/solo-io/packer-plugin-arm-image/pkg/image/arch"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/gpt"
 	"github.com/solo-io/packer-plugin-arm-image/pkg/image/utils"
 
 	getter "github.com/hashicorp/go-getter/v2"
@@ -43,10 +44,17 @@ var (
 	}
 
 	knownQemu = map[arch.KnownArchType]string{
-		arch.Arm:     "qemu-arm-static",
-		arch.ArmBE:   "qemu-armeb-static",
-		arch.Arm64:   "qemu-aarch64-static",
-		arch.Arm64BE: "qemu-aarch64_be-static",
+		arch.Arm:      "qemu-arm-static",
+		arch.ArmBE:    "qemu-armeb-static",
+		arch.Arm64:    "qemu-aarch64-static",
+		arch.Arm64BE:  "qemu-aarch64_be-static",
+		arch.Riscv64:  "qemu-riscv64-static",
+		arch.I386:     "qemu-i386-static",
+		arch.Amd64:    "qemu-x86_64-static",
+		arch.Mips:     "qemu-mips-static",
+		arch.MipsLE:   "qemu-mipsel-static",
+		arch.Mips64:   "qemu-mips64-static",
+		arch.Mips64LE: "qemu-mips64el-static",
 	}
 
 	defaultBase = [][]string{
@@ -72,6 +80,20 @@ const (
 	Delete   ResolvConfBehavior = "delete"
 )
 
+type OutputFormat string
+
+const (
+	Raw           OutputFormat = "raw"
+	AndroidSparse OutputFormat = "android-sparse"
+)
+
+type PartitionTable string
+
+const (
+	Dos PartitionTable = "dos"
+	Gpt PartitionTable = "gpt"
+)
+
 const ChrootKey = "mount_path"
 
 var generatedDataKeys = map[string]string{
@@ -95,6 +117,122 @@ func (b *Builder) autoDetectType() utils.KnownImageType {
 	return utils.GuessImageType(url)
 }
 
+// resolveQemuBinary returns the full path of a qemu binary. If it is not in the path, the
+// embedded binary is copied to the packer cache.
+func resolveQemuBinary(qemu string, disableEmbedded bool) (string, []string, error) {
+	path, err := exec.LookPath(qemu)
+	if err == nil {
+		// found it in the path
+		if !strings.Contains(path, "qemu-") {
+			return path, []string{"binary doesn't look like qemu-user"}, nil
+		}
+		return path, nil, nil
+	}
+
+	// not found in path, check if if we have it embedded
+	if disableEmbedded {
+		return "", nil, fmt.Errorf("qemu binary not found.")
+	}
+	// try to fetch an embedded version
+	embeddedQ, err := embed.GetEmbededQemu(qemu)
+	if err != nil {
+		return "", nil, fmt.Errorf("embedded qemu is not available - %w", err)
+	}
+	defer embeddedQ.Close()
+	qemupathincache, err := packer.CachePath(qemu)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot cache qemu - %w", err)
+	}
+	if _, err := os.Stat(qemupathincache); err == nil {
+		return qemupathincache, nil, nil
+	} else if !os.IsNotExist(err) {
+		return "", nil, fmt.Errorf("unknown cache error - %w", err)
+	}
+	// copy to cache folder, make executable, and use as path.
+	cachedFile, err := os.OpenFile(qemupathincache, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot cache - %w", err)
+	}
+	defer cachedFile.Close()
+	io.Copy(cachedFile, embeddedQ)
+	return qemupathincache, nil, nil
+}
+
+// resolveQemu sets the qemu binary of the image architecture if qemu_binary is not set, and
+// resolves its path if qemu is needed (or always is true).
+func (c *Config) resolveQemu(always bool) ([]string, error) {
+	if c.QemuBinary == "" {
+		c.QemuBinary = knownQemu[c.ImageArch]
+	} else if c.QemuBinary != knownQemu[c.ImageArch] {
+		// If the user provided a non-default qemu, make sure we use it
+		c.QemuRequired = true
+	}
+	if !c.qemuNeeded() && !always {
+		return nil, nil
+	}
+	path, warnings, err := resolveQemuBinary(c.QemuBinary, c.DisableEmbedded)
+	if err != nil {
+		return warnings, err
+	}
+	c.QemuBinary = path
+	return warnings, nil
+}
+
+// preparePartitions validates image_partitions, and uses their mountpoints as image_mounts.
+func (b *Builder) preparePartitions() []error {
+	var errs []error
+	switch b.config.PartitionTable {
+	case "":
+		b.config.PartitionTable = Dos
+	case Dos, Gpt:
+	default:
+		errs = append(errs, fmt.Errorf("unknown partition_table. must be one of: %v", []PartitionTable{Dos, Gpt}))
+	}
+	if b.config.PartitionTable == Dos && len(b.config.ImagePartitions) > 4 {
+		errs = append(errs, errors.New("dos partition tables can't have more than 4 partitions, use gpt"))
+	}
+	if b.config.PartitionTable == Gpt && len(b.config.ImagePartitions) > gpt.NewTableEntries {
+		errs = append(errs, fmt.Errorf("gpt partition tables can't have more than %d partitions", gpt.NewTableEntries))
+	}
+
+	for i, p := range b.config.ImagePartitions {
+		errs = append(errs, p.validate(fmt.Sprintf("image_partitions[%d]", i), b.config.PartitionTable)...)
+	}
+
+	if len(b.config.ImageMounts) == 0 && len(b.config.ImageMountSpecs) == 0 {
+		for _, p := range b.config.ImagePartitions {
+			b.config.ImageMounts = append(b.config.ImageMounts, p.Mountpoint)
+		}
+	}
+	return errs
+}
+
+// validate checks the partition for the given partition table. If the table is empty, the type
+// must be valid for either dos or GPT.
+func (p ImagePartition) validate(name string, table PartitionTable) []error {
+	var errs []error
+	if p.Size == 0 {
+		errs = append(errs, fmt.Errorf("%s: size is required", name))
+	}
+	if _, ok := mkfsCommands[p.Filesystem]; !ok && p.Filesystem != "" {
+		errs = append(errs, fmt.Errorf("%s: unknown filesystem %q", name, p.Filesystem))
+	}
+	if strings.Contains(p.Label, "'") {
+		errs = append(errs, fmt.Errorf("%s: bad label %q", name, p.Label))
+	}
+	_, dosErr := p.dosType()
+	_, gptErr := p.gptType()
+	switch {
+	case table == Dos && dosErr != nil:
+		errs = append(errs, fmt.Errorf("%s: %v", name, dosErr))
+	case table == Gpt && gptErr != nil:
+		errs = append(errs, fmt.Errorf("%s: %v", name, gptErr))
+	case table == "" && dosErr != nil && gptErr != nil:
+		errs = append(errs, fmt.Errorf("%s: unknown partition type %q", name, p.partitionType()))
+	}
+	return errs
+}
+
 func (b *Builder) ConfigSpec() hcldec.ObjectSpec {
 	return b.config.FlatMapstructure().HCL2Spec()
 }
@@ -113,9 +251,16 @@ func (b *Builder) Prepare(cfgs ...interface{}) ([]string, []string, error) {
 	}
 	var errs *packer.MultiError
 	var warnings []string
-	isoWarnings, isoErrs := b.config.ISOConfig.Prepare(&b.config.ctx)
-	warnings = append(warnings, isoWarnings...)
-	errs = packer.MultiErrorAppend(errs, isoErrs...)
+	if len(b.config.ImagePartitions) > 0 {
+		if b.config.RawSingleISOUrl != "" || len(b.config.ISOUrls) > 0 {
+			errs = packer.MultiErrorAppend(errs, errors.New("iso_url can't be used with image_partitions"))
+		}
+		errs = packer.MultiErrorAppend(errs, b.preparePartitions()...)
+	} else {
+		isoWarnings, isoErrs := b.config.ISOConfig.Prepare(&b.config.ctx)
+		warnings = append(warnings, isoWarnings...)
+		errs = packer.MultiErrorAppend(errs, isoErrs...)
+	}
 
 	if b.config.OutputFile == "" {
 		if b.config.OutputDir != "" {
@@ -126,10 +271,60 @@ func (b *Builder) Prepare(cfgs ...interface{}) ([]string, []string, error) {
 		}
 	}
 
+	if b.config.InPlace {
+		if len(b.config.ISOUrls) != 1 {
+			errs = packer.MultiErrorAppend(errs, errors.New("in_place requires a single iso_url"))
+		} else if _, ok := localPath(b.config.ISOUrls[0]); !ok {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("in_place requires a local image: %s", b.config.ISOUrls[0]))
+		}
+		if b.config.StreamDownload || b.config.CacheDecompressedImage {
+			errs = packer.MultiErrorAppend(errs, errors.New("in_place can't be used with stream_download or cache_decompressed_image"))
+		}
+		if b.config.OutputFormat != "" && b.config.OutputFormat != Raw {
+			errs = packer.MultiErrorAppend(errs, errors.New("in_place requires the raw output_format"))
+		}
+		if b.config.ISOChecksum != "" && b.config.ISOChecksum != "none" {
+			warnings = append(warnings, "iso_checksum is not verified with in_place.")
+		}
+	}
+
+	if b.config.StreamDownload {
+		for _, u := range b.config.ISOUrls {
+			if !canStream(u) {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("stream_download only supports local files and http(s) urls: %s", u))
+			} else if format, ok := randomAccessFormat(u); ok {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("%s images can't be decoded while they are downloaded, unset stream_download: %s", format, u))
+			}
+		}
+		if b.config.TargetPath != "" {
+			warnings = append(warnings, "iso_target_path is not used with stream_download, the download is not stored.")
+		}
+	}
+
+	if b.config.CacheDecompressedImage {
+		if b.config.StreamDownload {
+			warnings = append(warnings, "cache_decompressed_image is not used with stream_download.")
+		} else if b.config.ISOChecksum == "" || b.config.ISOChecksum == "none" {
+			errs = packer.MultiErrorAppend(errs, errors.New("cache_decompressed_image requires iso_checksum"))
+		}
+	}
+
+	switch b.config.OutputFormat {
+	case "":
+		b.config.OutputFormat = Raw
+	case Raw, AndroidSparse:
+	default:
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("unknown output_format. must be one of: %v", []OutputFormat{Raw, AndroidSparse}))
+	}
+
 	if b.config.LastPartitionExtraSize > 0 {
 		warnings = append(warnings, "last_partition_extra_size is deprecated, use target_image_size to grow your image")
 	}
 
+	if b.config.MinimizeImage && b.config.MinimizeHeadroom == 0 {
+		b.config.MinimizeHeadroom = 128 * 1024 * 1024
+	}
+
 	if b.config.ChrootMounts == nil {
 		b.config.ChrootMounts = make([][]string, 0)
 	}
@@ -153,10 +348,8 @@ func (b *Builder) Prepare(cfgs ...interface{}) ([]string, []string, error) {
 		b.config.CommandWrapper = "{{.Command}}"
 	}
 
-	if b.config.ImageType == "" {
-		// defaults...
-		b.config.ImageType = b.autoDetectType()
-	} else {
+	// if the image type is not set, it is detected from the image when building.
+	if b.config.ImageType != "" {
 		if _, ok := knownTypes[b.config.ImageType]; !ok {
 
 			var validvalues []utils.KnownImageType
@@ -168,9 +361,6 @@ func (b *Builder) Prepare(cfgs ...interface{}) ([]string, []string, error) {
 		}
 	}
 	if b.config.ImageType != "" {
-		if len(b.config.ImageMounts) == 0 {
-			b.config.ImageMounts = knownTypes[b.config.ImageType]
-		}
 		if len(b.config.QemuArgs) == 0 {
 			b.config.QemuArgs = knownArgs[b.config.ImageType]
 		}
@@ -180,63 +370,47 @@ func (b *Builder) Prepare(cfgs ...interface{}) ([]string, []string, error) {
 		}
 	}
 
-	if len(b.config.ImageMounts) == 0 {
-		errs = packer.MultiErrorAppend(errs, fmt.Errorf("no image mounts provided. Please set the image mounts or image type."))
+	if len(b.config.ImageMountSpecs) > 0 {
+		if len(b.config.ImageMounts) > 0 {
+			errs = packer.MultiErrorAppend(errs, errors.New("image_mounts and image_mount_specs can't be used together"))
+		}
+		for i, spec := range b.config.ImageMountSpecs {
+			if _, _, err := parsePartitionSelector(spec.Partition); err != nil {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("image_mount_specs[%d]: %v", i, err))
+			}
+			if spec.Mountpoint == "" {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("image_mount_specs[%d]: mountpoint is required", i))
+			}
+		}
+	}
+
+	if len(b.config.ExtraPartitions) > 0 {
+		if len(b.config.ImagePartitions) > 0 {
+			errs = packer.MultiErrorAppend(errs, errors.New("extra_partitions can't be used with image_partitions, add them to image_partitions instead"))
+		}
+		if b.config.InPlace || b.config.MinimizeImage {
+			errs = packer.MultiErrorAppend(errs, errors.New("extra_partitions can't be used with in_place or minimize_image"))
+		}
+		for i, p := range b.config.ExtraPartitions {
+			errs = packer.MultiErrorAppend(errs, p.validate(fmt.Sprintf("extra_partitions[%d]", i), "")...)
+		}
 	}
 
-	if b.config.ImageArch == arch.Unknown {
+	// the architecture and qemu binary are detected from the image when they are not set.
+	b.config.imageArchSet = b.config.ImageArch != arch.Unknown
+	b.config.qemuBinarySet = b.config.QemuBinary != ""
+	if !b.config.imageArchSet {
+		// the qemu binary is resolved by stepDetectArch, once the architecture is known.
 		b.config.ImageArch = arch.Arm
 	} else if !b.config.ImageArch.Valid() {
 		errs = packer.MultiErrorAppend(errs, fmt.Errorf("unknown image_arch. must be one of: %v", arch.Values()))
-		b.config.ImageArch = arch.Arm
-	}
-
-	if b.config.QemuBinary == "" {
-		b.config.QemuBinary = knownQemu[b.config.ImageArch]
-	} else if b.config.QemuBinary != knownQemu[b.config.ImageArch] {
-		// If the user provided a non-default qemu, make sure we use it
-		b.config.QemuRequired = true
-	}
-	// convert to full path
-	path, err := exec.LookPath(b.config.QemuBinary)
-	if err != nil {
-		// not found in path, check if if we have it embedded
-		if b.config.DisableEmbedded {
-			errs = packer.MultiErrorAppend(errs, fmt.Errorf("qemu binary not found."))
-		} else {
-			// try to fetch an embedded version
-			embeddedQ, err := embed.GetEmbededQemu(b.config.QemuBinary)
-			if err != nil {
-				errs = packer.MultiErrorAppend(errs, fmt.Errorf("embedded qemu is not available - %w", err))
-			} else {
-				defer embeddedQ.Close()
-				qemupathincache, err := packer.CachePath(b.config.QemuBinary)
-				if err != nil {
-					errs = packer.MultiErrorAppend(errs, fmt.Errorf("cannot cache qemu - %w", err))
-				} else if _, err := os.Stat(qemupathincache); os.IsNotExist(err) {
-					// copy to cache folder, make executable, and use as path.
-					// also check if it exists before copying.
-					cachedFile, err := os.OpenFile(qemupathincache, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
-					if err != nil {
-						errs = packer.MultiErrorAppend(errs, fmt.Errorf("cannot cache - %w", err))
-					} else {
-						defer cachedFile.Close()
-						io.Copy(cachedFile, embeddedQ)
-						b.config.QemuBinary = qemupathincache
-					}
-				} else if err == nil {
-					b.config.QemuBinary = qemupathincache
-				} else {
-					errs = packer.MultiErrorAppend(errs, fmt.Errorf("unknown cache error - %w", err))
-				}
-			}
-		}
 	} else {
-		// found it in the path, set the config to it!
-		if !strings.Contains(path, "qemu-") {
-			warnings = append(warnings, "binary doesn't look like qemu-user")
+		// the qemu_args of an image type detected from the image may require qemu.
+		qemuWarnings, err := b.config.resolveQemu(b.config.ImageType == "")
+		warnings = append(warnings, qemuWarnings...)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
 		}
-		b.config.QemuBinary = path
 	}
 
 	log.Println("qemu path", b.config.QemuBinary)
@@ -264,7 +438,9 @@ func init() {
 }
 
 func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (packer.Artifact, error) {
-	ui.Say(fmt.Sprintf("Image type: %s", b.config.ImageType))
+	if b.config.ImageType != "" {
+		ui.Say(fmt.Sprintf("Image type: %s", b.config.ImageType))
+	}
 
 	wrappedCommand := func(command string) (string, error) {
 		b.config.ctx.Data = &wrappedCommandTemplate{Command: command}
@@ -278,30 +454,79 @@ func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (pack
 	state.Put("ui", ui)
 	state.Put("wrappedCommand", packer_common_common.CommandWrapper(wrappedCommand))
 
-	steps := []multistep.Step{
-		&packer_common_commonsteps.StepDownload{
-			Checksum:    b.config.ISOChecksum,
-			Description: "Image",
-			ResultKey:   "iso_path",
-			Url:         b.config.ISOUrls,
-			Extension:   b.config.TargetExtension,
-			TargetPath:  b.config.TargetPath,
-		},
-		&stepCopyImage{FromKey: "iso_path", ResultKey: "imagefile", ImageOpener: image.NewImageOpener(ui)},
+	opener := image.NewImageOpenerWithConfig(ui, image.OpenerConfig{ArchiveMember: b.config.TargetMember, Workers: b.config.DecompressionWorkers})
+	var steps []multistep.Step
+	if len(b.config.ImagePartitions) > 0 {
+		steps = append(steps,
+			&stepCreateImage{ResultKey: "imagefile"},
+		)
+	} else if b.config.InPlace {
+		steps = append(steps,
+			&stepInPlaceImage{ResultKey: "imagefile", ImageOpener: opener},
+		)
+	} else if b.config.StreamDownload {
+		steps = append(steps,
+			&stepStreamDownload{Checksum: b.config.ISOChecksum, Url: b.config.ISOUrls, ResultKey: "imagefile", ImageOpener: opener},
+		)
+	} else {
+		steps = append(steps,
+			&packer_common_commonsteps.StepDownload{
+				Checksum:    b.config.ISOChecksum,
+				Description: "Image",
+				ResultKey:   "iso_path",
+				Url:         b.config.ISOUrls,
+				Extension:   b.config.TargetExtension,
+				TargetPath:  b.config.TargetPath,
+			},
+			&stepCopyImage{FromKey: "iso_path", ResultKey: "imagefile", ImageOpener: opener},
+		)
 	}
 
 	if b.config.LastPartitionExtraSize > 0 || b.config.TargetImageSize > 0 {
 		steps = append(steps,
-			&stepResizeLastPart{FromKey: "imagefile"},
+			&stepResizeLastPart{FromKey: "imagefile", ResultKey: "grown_partition"},
+		)
+	}
+	if len(b.config.ExtraPartitions) > 0 {
+		steps = append(steps,
+			&stepAddPartitions{FromKey: "imagefile"},
 		)
 	}
 
 	steps = append(steps,
 		&stepMapImage{ImageKey: "imagefile", ResultKey: "partitions"},
 	)
+	if len(b.config.ImagePartitions) > 0 {
+		steps = append(steps,
+			&stepFormatPartitions{PartitionsKey: "partitions", Partitions: b.config.ImagePartitions},
+		)
+	}
 	if b.config.LastPartitionExtraSize > 0 || b.config.TargetImageSize > 0 {
 		steps = append(steps,
-			&stepResizeFs{PartitionsKey: "partitions"},
+			&stepResizeFs{PartitionsKey: "partitions", PartitionNumberKey: "grown_partition"},
+		)
+	}
+	if len(b.config.ExtraPartitions) > 0 {
+		steps = append(steps,
+			&stepFormatPartitions{PartitionsKey: "partitions", Partitions: b.config.ExtraPartitions},
+		)
+	}
+	detectType := b.config.ImageType == "" && len(b.config.ImagePartitions) == 0
+	deriveMounts := len(b.config.ImageMounts) == 0 && len(b.config.ImageMountSpecs) == 0
+	if detectType || deriveMounts {
+		steps = append(steps,
+			&stepProbeImage{PartitionsKey: "partitions", ResultKey: "image_probe"},
+		)
+	}
+	if detectType {
+		steps = append(steps,
+			&stepDetectImageType{PartitionsKey: "partitions", ProbeKey: "image_probe", Hint: b.autoDetectType()},
+		)
+	}
+	if deriveMounts {
+		// the mounts are read from /etc/fstab, or are those of the image type.
+		steps = append(steps,
+			&stepDeriveMounts{PartitionsKey: "partitions", ProbeKey: "image_probe"},
 		)
 	}
 
@@ -312,6 +537,18 @@ func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (pack
 			MountPath:        b.config.MountPath,
 			GeneratedDataKey: generatedDataKeys[ChrootKey],
 		},
+	)
+	if b.config.RootfsSource != "" {
+		steps = append(steps,
+			&stepPopulateRootfs{ChrootKey: ChrootKey},
+		)
+	}
+	if len(b.config.ExtraPartitions) > 0 {
+		steps = append(steps,
+			&stepAddFstabEntries{PartitionsKey: "partitions", ChrootKey: ChrootKey, Partitions: b.config.ExtraPartitions},
+		)
+	}
+	steps = append(steps,
 		&chroot.StepMountExtra{
 			ChrootMounts: b.config.ChrootMounts,
 		},
@@ -323,10 +560,14 @@ func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (pack
 			&stepHandleResolvConf{ChrootKey: ChrootKey, Delete: b.config.ResolvConf == Delete})
 	}
 
-	if !b.config.ImageArch.IsNative() || b.config.QemuRequired {
+	steps = append(steps,
+		&stepDetectArch{ChrootKey: ChrootKey},
+	)
+	// qemu may be needed for the architecture or image type detected from the image.
+	if b.config.qemuNeeded() || !b.config.imageArchSet || b.config.ImageType == "" {
 		steps = append(steps,
-			&stepQemuUserStatic{ChrootKey: ChrootKey, PathToQemuInChrootKey: "qemuInChroot", Args: Args{Args: b.config.QemuArgs}},
-			&stepRegisterBinFmt{QemuPathKey: "qemuInChroot"},
+			&stepQemuUserStatic{ChrootKey: ChrootKey, PathToQemuInChrootKey: "qemuInChroot", FixBinaryKey: "binfmtFixBinary"},
+			&stepRegisterBinFmt{ChrootKey: ChrootKey, QemuPathKey: "qemuInChroot", FixBinaryKey: "binfmtFixBinary"},
 		)
 	}
 
@@ -334,6 +575,23 @@ func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (pack
 		&chroot.StepChrootProvision{},
 	)
 
+	if b.config.MinimizeImage {
+		steps = append(steps,
+			&stepEarlyCleanup{},
+			&stepMapImage{ImageKey: "imagefile", ResultKey: "shrink_partitions"},
+			&stepShrinkFs{FromKey: "imagefile", PartitionsKey: "shrink_partitions", ResultKey: "shrink_fs_size"},
+			&stepEarlyCleanup{},
+			&stepShrinkLastPart{FromKey: "imagefile", FsSizeKey: "shrink_fs_size"},
+		)
+	}
+
+	if b.config.OutputFormat == AndroidSparse {
+		steps = append(steps,
+			&stepEarlyCleanup{},
+			&stepAndroidSparse{FromKey: "imagefile"},
+		)
+	}
+
 	b.runner = &multistep.BasicRunner{Steps: steps}
 
 	// Executes the steps
@@ -351,12 +609,15 @@ func (b *Builder) Run(ctx context.Context, ui packer.Ui, hook packer.Hook) (pack
 
 	return &Artifact{
 		image:     state.Get("imagefile").(string),
+		inPlace:   b.config.InPlace,
 		StateData: map[string]interface{}{"generated_data": state.Get("generated_data")},
 	}, nil
 }
 
 type Artifact struct {
-	image     string
+	image string
+	// the image is the source image of the build, which is never deleted.
+	inPlace   bool
 	StateData map[string]interface{}
 }
 
@@ -381,5 +642,9 @@ func (a *Artifact) State(name string) interface{} {
 }
 
 func (a *Artifact) Destroy() error {
+	if a.inPlace {
+		log.Println("not deleting the source image modified in place", a.image)
+		return nil
+	}
 	return os.Remove(a.image)
 }
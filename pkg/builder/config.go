@@ -1,5 +1,5 @@
 //go:generate go run github.com/hashicorp/packer-plugin-sdk/cmd/packer-sdc struct-markdown
-//go:generate go run github.com/hashicorp/packer-plugin-sdk/cmd/packer-sdc mapstructure-to-hcl2 -type Config
+//go:generate go run github.com/hashicorp/packer-plugin-sdk/cmd/packer-sdc mapstructure-to-hcl2 -type Config,ImagePartition,ImageMountSpec
 
 package builder
 
@@ -17,6 +17,27 @@ type Config struct {
 	// Provide the arm image in the iso_url fields.
 	packer_common_commonsteps.ISOConfig `mapstructure:",squash"`
 
+	// Create a new image with these partitions, instead of starting from the image in iso_url.
+	// The partitions are formatted, and populated from `rootfs_source` before provisioning.
+	ImagePartitions []ImagePartition `mapstructure:"image_partitions"`
+	// Partition table of the image created with `image_partitions`: dos or gpt. Defaults to dos.
+	PartitionTable PartitionTable `mapstructure:"partition_table"`
+	// Root filesystem of the image created with `image_partitions`: a tarball (e.g. made by
+	// mmdebstrap), possibly compressed, or a directory. It is copied into the mounted partitions,
+	// so that the files under /boot end up on the boot partition. Leave empty for empty filesystems.
+	RootfsSource string `mapstructure:"rootfs_source"`
+
+	// Partitions to add after the last partition of the image, e.g. a data partition. They are
+	// added after the image is grown with `target_image_size`, formatted, mounted at their
+	// mountpoint and added to /etc/fstab.
+	// A dos partition table can't have more than 4 partitions.
+	ExtraPartitions []ImagePartition `mapstructure:"extra_partitions"`
+
+	// Name or glob pattern of the image file, when the source is an archive (zip, tar, tar.gz, ...)
+	// that contains other files as well, like README or checksum files. If not provided, the file
+	// with an image extension (.img, .raw, .iso, .bin) is used.
+	TargetMember string `mapstructure:"iso_target_member"`
+
 	// Lets you prefix all builder commands, such as with ssh for a remote build host. Defaults to "".
 	// Copied from other builders :)
 	CommandWrapper string `mapstructure:"command_wrapper"`
@@ -28,19 +49,59 @@ type Config struct {
 	// Output filename, where the final image will be stored
 	OutputFile string `mapstructure:"output_filename"`
 
+	// Maximum size of the decompressed source image, in bytes. The build fails if the image is
+	// bigger, instead of filling up the disk. Before copying, the estimated size of the image (or
+	// this size, if it can't be estimated) is checked against the free space in the output directory,
+	// with a warning if it may not fit.
+	MaxImageSize uint64 `mapstructure:"max_image_size"`
+	// Number of threads used to decompress multi-block xz images (as written by `xz -T`) and
+	// multi-member gzip images (e.g. bgzip output, or concatenated gzip files) when xzcat and zcat
+	// are not available. Other gzip images are a single deflate stream that can't be decompressed
+	// in parallel, they are only read ahead by this many blocks. Defaults to the number of CPUs.
+	DecompressionWorkers int `mapstructure:"decompression_workers"`
+	// Decompress the source image while it is downloaded, straight into the output image, instead
+	// of downloading it to the packer cache first. This saves a pass over the image and the disk
+	// space of the download, but the download is not cached. The checksum is still verified before
+	// the build goes on. Only local files and http(s) urls can be streamed, and zip files and
+	// virtual machine images can't.
+	StreamDownload bool `mapstructure:"stream_download"`
+	// Keep the decompressed source image in the packer cache directory, and clone it instead of
+	// decompressing the source again in the next builds. The cached image is identified by
+	// iso_checksum, which is required. On filesystems with reflinks (btrfs, xfs) the clones share
+	// their data with the cache, otherwise each clone is a sparse copy. Not used with stream_download.
+	CacheDecompressedImage bool `mapstructure:"cache_decompressed_image"`
+	// Modify the source image directly instead of copying it to output_filename, for quick local
+	// iterations. iso_url must be a single local raw image, which is locked during the build and is
+	// the artifact of the build. iso_checksum is not verified, as the image changes with every build.
+	// Note that without this option, raw source images are already cloned with a reflink on
+	// filesystems that support it.
+	InPlace bool `mapstructure:"in_place"`
+
+	// Format of the final image. Can be one of: raw, android-sparse. Defaults to raw.
+	// android-sparse writes the image in the Android sparse format, that can be flashed with fastboot.
+	OutputFormat OutputFormat `mapstructure:"output_format"`
+
 	// Image type. this is used to deduce other settings like image mounts and qemu args.
-	// If not provided, we will try to deduce it from the image url. (see autoDetectType())
+	// If not provided, it is detected from the contents of the image: its boot files, /etc/os-release
+	// and /etc/armbian-release. The image url is only used as a hint. (see stepDetectImageType)
 	// For list of valid values, see: pkg/image/utils/images.go
 	ImageType utils.KnownImageType `mapstructure:"image_type"`
 
 	// Image's target CPU architecture.
 	// This is used to determine if qemu is necessary and which flavor to use.
-	// Defaults to "arm". For list of valid values, see: pkg/image/arch/arch.go
+	// If not set, it is detected from the ELF header of /bin/sh in the image, and defaults to "arm".
+	// For list of valid values, see: pkg/image/arch/arch.go
 	ImageArch arch.KnownArchType `mapstructure:"image_arch"`
 
 	// Where to mounts the image partitions in the chroot.
 	// first entry is the mount point of the first partition. etc..
+	// If neither this nor `image_mount_specs` are set, the mounts are read from the /etc/fstab of
+	// the largest linux partition, or are those of `image_type` if the image has no fstab.
 	ImageMounts []string `mapstructure:"image_mounts"`
+	// Select the partitions to mount by label, UUID or number, instead of their position in
+	// `image_mounts`. The partitions that are not selected are not mounted. Can't be used with
+	// `image_mounts`.
+	ImageMountSpecs []ImageMountSpec `mapstructure:"image_mount_specs"`
 
 	// The path where the volume will be mounted. This is where the chroot environment will be.
 	// Will be a temporary directory if left unspecified.
@@ -62,12 +123,19 @@ type Config struct {
 	ResolvConf ResolvConfBehavior `mapstructure:"resolv-conf"`
 
 	// Should the last partition be extended? this only works for the last partition in the
-	// dos partition table, and ext filesystem
+	// dos or GPT partition table, and ext, btrfs, xfs or f2fs filesystem
 	LastPartitionExtraSize uint64 `mapstructure:"last_partition_extra_size"`
 	// The target size of the final image. The last partition will be extended to
 	// fill up this much room. I.e. if the generated image is 256MB and TargetImageSize
 	// is set to 384MB the last partition will be extended with an additional 128MB.
 	TargetImageSize uint64 `mapstructure:"target_image_size"`
+	// Shrink the image after provisioning: the filesystem on the last partition is shrunk to its
+	// minimal size plus `minimize_headroom`, the last partition is shrunk to fit, and the image
+	// file is truncated after it. This only works for the last partition in the dos or GPT
+	// partition table, and ext filesystem.
+	MinimizeImage bool `mapstructure:"minimize_image"`
+	// Free space to leave in the filesystem when using `minimize_image`. Defaults to 128MB.
+	MinimizeHeadroom uint64 `mapstructure:"minimize_headroom"`
 
 	// Qemu binary to use. default is determined based on `image_arch`.
 	// If this is an absolute path, it will be used. Otherwise, we will look for one in your PATH
@@ -82,4 +150,40 @@ type Config struct {
 	QemuRequired bool `mapstructure:"qemu_required"`
 
 	ctx interpolate.Context
+	// whether image_arch and qemu_binary were set, or are defaults.
+	imageArchSet  bool
+	qemuBinarySet bool
+}
+
+// qemuNeeded returns whether the commands in the chroot run with qemu.
+func (c *Config) qemuNeeded() bool {
+	return !c.ImageArch.IsNative() || c.QemuRequired
+}
+
+// ImagePartition is a partition of an image created with `image_partitions`.
+type ImagePartition struct {
+	// Size of the partition, in bytes. It is rounded up to a multiple of 1MB.
+	Size uint64 `mapstructure:"size" required:"true"`
+	// Partition type: linux, fat32, efi or swap. A partition type code (e.g. `0c`) for dos
+	// partition tables, or a type GUID for GPT, can be used as well. Defaults to fat32 for vfat
+	// filesystems, swap for swap and linux for the others.
+	Type string `mapstructure:"type"`
+	// Filesystem to create on the partition: ext2, ext3, ext4, vfat, btrfs, xfs, f2fs or swap.
+	// The partition is not formatted if empty.
+	Filesystem string `mapstructure:"filesystem"`
+	// Label of the filesystem. With a GPT partition table, this is also the name of the partition.
+	Label string `mapstructure:"label"`
+	// Where the partition is mounted in the chroot, e.g. `/` or `/boot`. Used as `image_mounts`
+	// when they are not set.
+	Mountpoint string `mapstructure:"mountpoint"`
+}
+
+// ImageMountSpec mounts the partition selected by Partition at Mountpoint.
+type ImageMountSpec struct {
+	// The partition to mount: its number (e.g. `2`), or `PARTLABEL=`, `PARTUUID=`, `LABEL=`, `UUID=`
+	// or `TYPE=` followed by the partition name, partition UUID, filesystem label, filesystem UUID
+	// or filesystem type. It must match exactly one partition.
+	Partition string `mapstructure:"partition" required:"true"`
+	// Where the partition is mounted in the chroot, e.g. `/` or `/boot`.
+	Mountpoint string `mapstructure:"mountpoint" required:"true"`
 }
@@ -25,18 +25,32 @@ type FlatConfig struct {
 	ISOUrls                []string              `mapstructure:"iso_urls" cty:"iso_urls" hcl:"iso_urls"`
 	TargetPath             *string               `mapstructure:"iso_target_path" cty:"iso_target_path" hcl:"iso_target_path"`
 	TargetExtension        *string               `mapstructure:"iso_target_extension" cty:"iso_target_extension" hcl:"iso_target_extension"`
+	ImagePartitions        []FlatImagePartition  `mapstructure:"image_partitions" cty:"image_partitions" hcl:"image_partitions"`
+	PartitionTable         *PartitionTable       `mapstructure:"partition_table" cty:"partition_table" hcl:"partition_table"`
+	RootfsSource           *string               `mapstructure:"rootfs_source" cty:"rootfs_source" hcl:"rootfs_source"`
+	ExtraPartitions        []FlatImagePartition  `mapstructure:"extra_partitions" cty:"extra_partitions" hcl:"extra_partitions"`
+	TargetMember           *string               `mapstructure:"iso_target_member" cty:"iso_target_member" hcl:"iso_target_member"`
 	CommandWrapper         *string               `mapstructure:"command_wrapper" cty:"command_wrapper" hcl:"command_wrapper"`
 	OutputDir              *string               `mapstructure:"output_directory" cty:"output_directory" hcl:"output_directory"`
 	OutputFile             *string               `mapstructure:"output_filename" cty:"output_filename" hcl:"output_filename"`
+	MaxImageSize           *uint64               `mapstructure:"max_image_size" cty:"max_image_size" hcl:"max_image_size"`
+	DecompressionWorkers   *int                  `mapstructure:"decompression_workers" cty:"decompression_workers" hcl:"decompression_workers"`
+	StreamDownload         *bool                 `mapstructure:"stream_download" cty:"stream_download" hcl:"stream_download"`
+	CacheDecompressedImage *bool                 `mapstructure:"cache_decompressed_image" cty:"cache_decompressed_image" hcl:"cache_decompressed_image"`
+	InPlace                *bool                 `mapstructure:"in_place" cty:"in_place" hcl:"in_place"`
+	OutputFormat           *OutputFormat         `mapstructure:"output_format" cty:"output_format" hcl:"output_format"`
 	ImageType              *utils.KnownImageType `mapstructure:"image_type" cty:"image_type" hcl:"image_type"`
 	ImageArch              *arch.KnownArchType   `mapstructure:"image_arch" cty:"image_arch" hcl:"image_arch"`
 	ImageMounts            []string              `mapstructure:"image_mounts" cty:"image_mounts" hcl:"image_mounts"`
+	ImageMountSpecs        []FlatImageMountSpec  `mapstructure:"image_mount_specs" cty:"image_mount_specs" hcl:"image_mount_specs"`
 	MountPath              *string               `mapstructure:"mount_path" cty:"mount_path" hcl:"mount_path"`
 	ChrootMounts           [][]string            `mapstructure:"chroot_mounts" cty:"chroot_mounts" hcl:"chroot_mounts"`
 	AdditionalChrootMounts [][]string            `mapstructure:"additional_chroot_mounts" cty:"additional_chroot_mounts" hcl:"additional_chroot_mounts"`
 	ResolvConf             *ResolvConfBehavior   `mapstructure:"resolv-conf" cty:"resolv-conf" hcl:"resolv-conf"`
 	LastPartitionExtraSize *uint64               `mapstructure:"last_partition_extra_size" cty:"last_partition_extra_size" hcl:"last_partition_extra_size"`
 	TargetImageSize        *uint64               `mapstructure:"target_image_size" cty:"target_image_size" hcl:"target_image_size"`
+	MinimizeImage          *bool                 `mapstructure:"minimize_image" cty:"minimize_image" hcl:"minimize_image"`
+	MinimizeHeadroom       *uint64               `mapstructure:"minimize_headroom" cty:"minimize_headroom" hcl:"minimize_headroom"`
 	QemuBinary             *string               `mapstructure:"qemu_binary" cty:"qemu_binary" hcl:"qemu_binary"`
 	DisableEmbedded        *bool                 `mapstructure:"disable_embedded" cty:"disable_embedded" hcl:"disable_embedded"`
 	QemuArgs               []string              `mapstructure:"qemu_args" cty:"qemu_args" hcl:"qemu_args"`
@@ -68,18 +82,32 @@ func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 		"iso_urls":                   &hcldec.AttrSpec{Name: "iso_urls", Type: cty.List(cty.String), Required: false},
 		"iso_target_path":            &hcldec.AttrSpec{Name: "iso_target_path", Type: cty.String, Required: false},
 		"iso_target_extension":       &hcldec.AttrSpec{Name: "iso_target_extension", Type: cty.String, Required: false},
+		"image_partitions":           &hcldec.BlockListSpec{TypeName: "image_partitions", Nested: hcldec.ObjectSpec((*FlatImagePartition)(nil).HCL2Spec())},
+		"partition_table":            &hcldec.AttrSpec{Name: "partition_table", Type: cty.String, Required: false},
+		"rootfs_source":              &hcldec.AttrSpec{Name: "rootfs_source", Type: cty.String, Required: false},
+		"extra_partitions":           &hcldec.BlockListSpec{TypeName: "extra_partitions", Nested: hcldec.ObjectSpec((*FlatImagePartition)(nil).HCL2Spec())},
+		"iso_target_member":          &hcldec.AttrSpec{Name: "iso_target_member", Type: cty.String, Required: false},
 		"command_wrapper":            &hcldec.AttrSpec{Name: "command_wrapper", Type: cty.String, Required: false},
 		"output_directory":           &hcldec.AttrSpec{Name: "output_directory", Type: cty.String, Required: false},
 		"output_filename":            &hcldec.AttrSpec{Name: "output_filename", Type: cty.String, Required: false},
+		"max_image_size":             &hcldec.AttrSpec{Name: "max_image_size", Type: cty.Number, Required: false},
+		"decompression_workers":      &hcldec.AttrSpec{Name: "decompression_workers", Type: cty.Number, Required: false},
+		"stream_download":            &hcldec.AttrSpec{Name: "stream_download", Type: cty.Bool, Required: false},
+		"cache_decompressed_image":   &hcldec.AttrSpec{Name: "cache_decompressed_image", Type: cty.Bool, Required: false},
+		"in_place":                   &hcldec.AttrSpec{Name: "in_place", Type: cty.Bool, Required: false},
+		"output_format":              &hcldec.AttrSpec{Name: "output_format", Type: cty.String, Required: false},
 		"image_type":                 &hcldec.AttrSpec{Name: "image_type", Type: cty.String, Required: false},
 		"image_arch":                 &hcldec.AttrSpec{Name: "image_arch", Type: cty.String, Required: false},
 		"image_mounts":               &hcldec.AttrSpec{Name: "image_mounts", Type: cty.List(cty.String), Required: false},
+		"image_mount_specs":          &hcldec.BlockListSpec{TypeName: "image_mount_specs", Nested: hcldec.ObjectSpec((*FlatImageMountSpec)(nil).HCL2Spec())},
 		"mount_path":                 &hcldec.AttrSpec{Name: "mount_path", Type: cty.String, Required: false},
 		"chroot_mounts":              &hcldec.AttrSpec{Name: "chroot_mounts", Type: cty.List(cty.List(cty.String)), Required: false},
 		"additional_chroot_mounts":   &hcldec.AttrSpec{Name: "additional_chroot_mounts", Type: cty.List(cty.List(cty.String)), Required: false},
 		"resolv-conf":                &hcldec.AttrSpec{Name: "resolv-conf", Type: cty.String, Required: false},
 		"last_partition_extra_size":  &hcldec.AttrSpec{Name: "last_partition_extra_size", Type: cty.Number, Required: false},
 		"target_image_size":          &hcldec.AttrSpec{Name: "target_image_size", Type: cty.Number, Required: false},
+		"minimize_image":             &hcldec.AttrSpec{Name: "minimize_image", Type: cty.Bool, Required: false},
+		"minimize_headroom":          &hcldec.AttrSpec{Name: "minimize_headroom", Type: cty.Number, Required: false},
 		"qemu_binary":                &hcldec.AttrSpec{Name: "qemu_binary", Type: cty.String, Required: false},
 		"disable_embedded":           &hcldec.AttrSpec{Name: "disable_embedded", Type: cty.Bool, Required: false},
 		"qemu_args":                  &hcldec.AttrSpec{Name: "qemu_args", Type: cty.List(cty.String), Required: false},
@@ -87,3 +115,59 @@ func (*FlatConfig) HCL2Spec() map[string]hcldec.Spec {
 	}
 	return s
 }
+
+// FlatImageMountSpec is an auto-generated flat version of ImageMountSpec.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatImageMountSpec struct {
+	Partition  *string `mapstructure:"partition" required:"true" cty:"partition" hcl:"partition"`
+	Mountpoint *string `mapstructure:"mountpoint" required:"true" cty:"mountpoint" hcl:"mountpoint"`
+}
+
+// FlatMapstructure returns a new FlatImageMountSpec.
+// FlatImageMountSpec is an auto-generated flat version of ImageMountSpec.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*ImageMountSpec) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatImageMountSpec)
+}
+
+// HCL2Spec returns the hcl spec of a ImageMountSpec.
+// This spec is used by HCL to read the fields of ImageMountSpec.
+// The decoded values from this spec will then be applied to a FlatImageMountSpec.
+func (*FlatImageMountSpec) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"partition":  &hcldec.AttrSpec{Name: "partition", Type: cty.String, Required: false},
+		"mountpoint": &hcldec.AttrSpec{Name: "mountpoint", Type: cty.String, Required: false},
+	}
+	return s
+}
+
+// FlatImagePartition is an auto-generated flat version of ImagePartition.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatImagePartition struct {
+	Size       *uint64 `mapstructure:"size" required:"true" cty:"size" hcl:"size"`
+	Type       *string `mapstructure:"type" cty:"type" hcl:"type"`
+	Filesystem *string `mapstructure:"filesystem" cty:"filesystem" hcl:"filesystem"`
+	Label      *string `mapstructure:"label" cty:"label" hcl:"label"`
+	Mountpoint *string `mapstructure:"mountpoint" cty:"mountpoint" hcl:"mountpoint"`
+}
+
+// FlatMapstructure returns a new FlatImagePartition.
+// FlatImagePartition is an auto-generated flat version of ImagePartition.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*ImagePartition) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatImagePartition)
+}
+
+// HCL2Spec returns the hcl spec of a ImagePartition.
+// This spec is used by HCL to read the fields of ImagePartition.
+// The decoded values from this spec will then be applied to a FlatImagePartition.
+func (*FlatImagePartition) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"size":       &hcldec.AttrSpec{Name: "size", Type: cty.Number, Required: false},
+		"type":       &hcldec.AttrSpec{Name: "type", Type: cty.String, Required: false},
+		"filesystem": &hcldec.AttrSpec{Name: "filesystem", Type: cty.String, Required: false},
+		"label":      &hcldec.AttrSpec{Name: "label", Type: cty.String, Required: false},
+		"mountpoint": &hcldec.AttrSpec{Name: "mountpoint", Type: cty.String, Required: false},
+	}
+	return s
+}
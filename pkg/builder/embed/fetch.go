@@ -38,7 +38,8 @@ func GetEmbededQemu(file string) (io.ReadCloser, error) {
 
 	f, err := content.Open("bins/" + file + ".gz")
 	if err != nil {
-		return nil, err
+		// only some architectures are embedded, see bins/sha256sums.
+		return nil, fmt.Errorf("%s is not embedded, please install qemu-user-static: %w", file, err)
 	}
 	gzf, err := gzip.NewReader(f)
 	if err != nil {
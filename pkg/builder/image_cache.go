@@ -0,0 +1,79 @@
+package builder
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/utils"
+)
+
+// decompressedCachePath returns the path of the decompressed source image in the packer cache.
+// The image is identified by the checksum of the source and the archive member, so it returns ""
+// if there is no checksum.
+func decompressedCachePath(ctx context.Context, config *Config) (string, error) {
+	if len(config.ISOUrls) == 0 {
+		return "", nil
+	}
+	checksum, err := sourceChecksum(ctx, config.ISOChecksum, config.ISOUrls[0])
+	if err != nil || checksum == nil {
+		return "", err
+	}
+	key := sha1.Sum([]byte(fmt.Sprintf("%s:%x\n%s", checksum.Type, checksum.Value, config.TargetMember)))
+	return packer.CachePath("arm-image", hex.EncodeToString(key[:])+".img")
+}
+
+// cachedImage is a decompressed image from the cache, that is cloned like a raw source image.
+type cachedImage struct {
+	*os.File
+	size uint64
+}
+
+func openCachedImage(path string) (*cachedImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &cachedImage{File: f, size: uint64(info.Size())}, nil
+}
+
+func (c *cachedImage) SizeEstimate() uint64 { return c.size }
+func (c *cachedImage) RawFile() *os.File    { return c.File }
+
+// storeDecompressed adds the decompressed image to the cache. The image is cloned, so it shares
+// its data with the cache on filesystems with reflinks. Concurrent builds may store the same
+// image, the last one wins.
+func storeDecompressed(imagefile, cachePath string) error {
+	src, err := os.Open(imagefile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), filepath.Base(cachePath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err := utils.CloneFile(tmp, src); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cachePath)
+}
@@ -0,0 +1,158 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/rekby/mbr"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/gpt"
+)
+
+// stepAddPartitions appends the partitions in extra_partitions to the image, after its last
+// partition. The image is grown to fit them.
+type stepAddPartitions struct {
+	FromKey string
+}
+
+func (s *stepAddPartitions) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	imagefile := state.Get(s.FromKey).(string)
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say(fmt.Sprintf("Adding %d partitions", len(config.ExtraPartitions)))
+	if err := addPartitions(imagefile, config.ExtraPartitions); err != nil {
+		err := fmt.Errorf("Error adding partitions: %v", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepAddPartitions) Cleanup(state multistep.StateBag) {
+}
+
+func addPartitions(imagefile string, partitions []ImagePartition) error {
+	m, err := getMbr(imagefile)
+	if m != nil && m.IsGPT() {
+		return addGptPartitions(imagefile, m, partitions)
+	}
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(imagefile, os.O_RDWR|os.O_SYNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// the new partitions go in the slots after the last used one, so that they are mapped after
+	// the existing partitions.
+	slots := m.GetAllPartitions()
+	first := 0
+	var end uint64
+	for i, p := range slots {
+		if !p.IsEmpty() {
+			first = i + 1
+			if last := uint64(p.GetLBAStart()) + uint64(p.GetLBALen()); last > end {
+				end = last
+			}
+		}
+	}
+	if first+len(partitions) > len(slots) {
+		return fmt.Errorf("the dos partition table has room for %d more partitions", len(slots)-first)
+	}
+
+	extents, size := layoutPartitions(end*gpt.SectorSize, partitions, Dos)
+	for i, p := range partitions {
+		code, err := p.dosType()
+		if err != nil {
+			return err
+		}
+		if extents[i].start+extents[i].sectors > 0xFFFFFFFF {
+			return errors.New("the image is too big for its dos partition table")
+		}
+		part := slots[first+i]
+		part.SetType(mbr.PartitionType(code))
+		part.SetLBAStart(uint32(extents[i].start))
+		part.SetLBALen(uint32(extents[i].sectors))
+	}
+
+	if err := growFile(f, size); err != nil {
+		return err
+	}
+	return m.Write(f)
+}
+
+func addGptPartitions(imagefile string, protective *mbr.MBR, partitions []ImagePartition) error {
+	f, err := os.OpenFile(imagefile, os.O_RDWR|os.O_SYNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	table, err := gpt.Read(f)
+	if err != nil {
+		return err
+	}
+
+	first := 0
+	end := table.Header.FirstUsableLBA
+	for i, p := range table.Partitions {
+		if !p.IsEmpty() {
+			first = i + 1
+			if p.EndingLBA+1 > end {
+				end = p.EndingLBA + 1
+			}
+		}
+	}
+	if first+len(partitions) > len(table.Partitions) {
+		return fmt.Errorf("the GPT has room for %d more partitions", len(table.Partitions)-first)
+	}
+
+	extents, size := layoutPartitions(end*gpt.SectorSize, partitions, Gpt)
+	for i, p := range partitions {
+		typeGUID, err := p.gptType()
+		if err != nil {
+			return err
+		}
+		table.Partitions[first+i] = gpt.Partition{
+			TypeGUID:    typeGUID,
+			UniqueGUID:  gpt.NewGUID(),
+			StartingLBA: extents[i].start,
+			EndingLBA:   extents[i].start + extents[i].sectors - 1,
+		}
+		table.Partitions[first+i].SetName(p.Label)
+	}
+
+	if err := growFile(f, size); err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	totalSectors := uint64(info.Size() >> SectorShift)
+	oldBackup := table.Header.AlternateLBA
+	if err := table.Resize(totalSectors); err != nil {
+		return err
+	}
+	return writeResizedGpt(f, table, protective, oldBackup, totalSectors)
+}
+
+// growFile truncates f to size, if it is smaller.
+func growFile(f *os.File, size int64) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() >= size {
+		return nil
+	}
+	return f.Truncate(size)
+}
@@ -0,0 +1,63 @@
+package builder
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/simg"
+)
+
+// stepAndroidSparse replaces the image with an Android sparse image of it.
+// The image must not be mapped or mounted anymore.
+type stepAndroidSparse struct {
+	FromKey string
+}
+
+func (s *stepAndroidSparse) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	imagefile := state.Get(s.FromKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say("Converting image to Android sparse format")
+	tmpfile := imagefile + ".simg"
+	if err := s.convert(imagefile, tmpfile); err != nil {
+		os.Remove(tmpfile)
+		ui.Error(fmt.Sprintf("Error converting image: %v", err))
+		return multistep.ActionHalt
+	}
+	if err := os.Rename(tmpfile, imagefile); err != nil {
+		os.Remove(tmpfile)
+		ui.Error(fmt.Sprintf("Error replacing image: %v", err))
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepAndroidSparse) convert(imagefile, tmpfile string) error {
+	src, err := os.Open(imagefile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	finfo, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.Create(tmpfile)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if err := simg.Write(dst, bufio.NewReaderSize(src, 1<<20), finfo.Size()); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
+
+func (s *stepAndroidSparse) Cleanup(state multistep.StateBag) {
+}
@@ -2,8 +2,10 @@ package builder
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"time"
@@ -18,21 +20,46 @@ import (
 type stepCopyImage struct {
 	FromKey, ResultKey string
 	ImageOpener        image.ImageOpener
-	ui                 packer.Ui
 }
 
 func (s *stepCopyImage) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
 	fromFile := state.Get(s.FromKey).(string)
 	config := state.Get("config").(*Config)
-	s.ui = state.Get("ui").(packer.Ui)
-	s.ui.Say("Copying source image.")
+	ui := state.Get("ui").(packer.Ui)
+	ui.Say("Copying source image.")
 
 	outputDir := filepath.Dir(config.OutputFile)
 	imageName := filepath.Base(config.OutputFile)
 
-	err := s.copy(ctx, state, fromFile, outputDir, imageName)
+	var cachePath string
+	var cached *cachedImage
+	if config.CacheDecompressedImage {
+		var err error
+		cachePath, err = decompressedCachePath(ctx, config)
+		if err != nil {
+			log.Printf("can't find the decompressed image in the cache: %v", err)
+		}
+		if cachePath != "" {
+			cached, _ = openCachedImage(cachePath)
+		}
+	}
+
+	var err error
+	if cached != nil {
+		ui.Say(fmt.Sprintf("Using the decompressed image from the cache: %s", cachePath))
+		err = writeImage(ctx, state, cached, config.OutputFile)
+		cached.Close()
+	} else {
+		err = s.copy(ctx, state, fromFile, outputDir, imageName)
+		if err == nil && cachePath != "" {
+			ui.Say(fmt.Sprintf("Caching the decompressed image: %s", cachePath))
+			if err := storeDecompressed(config.OutputFile, cachePath); err != nil {
+				ui.Error(fmt.Sprintf("Caching the decompressed image failed: %v", err))
+			}
+		}
+	}
 	if err != nil {
-		s.ui.Error(fmt.Sprintf("%v", err))
+		ui.Error(fmt.Sprintf("%v", err))
 		return multistep.ActionHalt
 	}
 
@@ -43,7 +70,17 @@ func (s *stepCopyImage) Run(ctx context.Context, state multistep.StateBag) multi
 func (s *stepCopyImage) Cleanup(state multistep.StateBag) {
 }
 
-func (s *stepCopyImage) copy_progress(ctx context.Context, state multistep.StateBag, dst io.Writer, src image.Image) error {
+func (s *stepCopyImage) copy(ctx context.Context, state multistep.StateBag, src, dir, filename string) error {
+	srcf, err := s.ImageOpener.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcf.Close()
+
+	return writeImage(ctx, state, srcf, filepath.Join(dir, filename))
+}
+
+func copy_progress(ctx context.Context, state multistep.StateBag, dst io.Writer, src image.Image) error {
 	ui := state.Get("ui").(packer.Ui)
 
 	ctx, cancel := context.WithCancel(ctx)
@@ -56,7 +93,7 @@ func (s *stepCopyImage) copy_progress(ctx context.Context, state multistep.State
 			case <-time.After(time.Second):
 				if _, ok := state.GetOk(multistep.StateCancelled); ok {
 					ui.Say("Interrupt received. Cancelling copy...")
-					break
+					return
 				}
 			case <-done:
 				return
@@ -69,30 +106,113 @@ func (s *stepCopyImage) copy_progress(ctx context.Context, state multistep.State
 
 }
 
-func (s *stepCopyImage) copy(ctx context.Context, state multistep.StateBag, src, dir, filename string) error {
+// writeImage writes the decoded image to dstpath. The output is removed if it fails.
+func writeImage(ctx context.Context, state multistep.StateBag, srcf image.Image, dstpath string) (err error) {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+	dir := filepath.Dir(dstpath)
 
-	srcf, err := s.ImageOpener.Open(src)
+	err = os.MkdirAll(dir, 0755)
 	if err != nil {
 		return err
 	}
-	defer srcf.Close()
 
-	err = os.MkdirAll(dir, 0755)
-	if err != nil {
+	if err := checkFreeSpace(ui, dir, srcf, config.MaxImageSize); err != nil {
 		return err
 	}
 
-	dstf, err := os.Create(filepath.Join(dir, filename))
+	dstf, err := os.Create(dstpath)
 	if err != nil {
 		return err
 	}
 	defer dstf.Close()
+	defer func() {
+		// don't leave a partial image behind
+		if err != nil {
+			dstf.Close()
+			os.Remove(dstpath)
+		}
+	}()
 
-	err = s.copy_progress(ctx, state, dstf, srcf)
+	if raw, ok := srcf.(image.RawImage); ok {
+		ui.Say("Source image is raw, cloning it.")
+		err = utils.CloneFile(dstf, raw.RawFile())
+		if err == nil {
+			return nil
+		}
+		log.Printf("cloning image failed, falling back to copy: %v", err)
+		// start over
+		if err := dstf.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := raw.RawFile().Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	var img image.Image = srcf
+	if config.MaxImageSize > 0 {
+		img = &limitedImage{Image: srcf, left: int64(config.MaxImageSize)}
+	}
+
+	// most of the image is usually zeros, don't write them.
+	sparse := utils.NewSparseWriter(dstf)
+	err = copy_progress(ctx, state, sparse, img)
 
 	if err != nil {
 		return err
 	}
 
+	return sparse.Finish()
+}
+
+// checkFreeSpace fails before copying if the image is bigger than maxSize, and warns if it may not
+// fit in the output directory. The image is written sparse, so its zeros don't take space and the
+// estimated size is only an upper bound of what's needed.
+func checkFreeSpace(ui packer.Ui, dir string, img image.Image, maxSize uint64) error {
+	needed := img.SizeEstimate()
+	if maxSize > 0 && needed > maxSize {
+		return fmt.Errorf("image is bigger than max_image_size: %v bytes > %v bytes", needed, maxSize)
+	}
+	if needed == 0 {
+		needed = maxSize
+	}
+	if needed == 0 {
+		return nil
+	}
+
+	free, err := utils.FreeSpace(dir)
+	if err != nil {
+		log.Printf("can't check free space in %s: %v", dir, err)
+		return nil
+	}
+	if needed > free {
+		ui.Error(fmt.Sprintf("WARNING: the image is up to %v MB, and only %v MB are available in %s. "+
+			"The zeros of the image are not written, so it may still fit.", needed/1024/1024, free/1024/1024, dir))
+	}
 	return nil
 }
+
+// limitedImage fails the copy of an image that is bigger than the limit, so that a
+// decompression bomb doesn't fill up the disk.
+type limitedImage struct {
+	image.Image
+	left int64
+}
+
+func (l *limitedImage) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		// we're at the limit, this is fine only if the image ends here.
+		var b [1]byte
+		if n, _ := io.ReadFull(l.Image, b[:]); n > 0 {
+			return 0, errors.New("image is bigger than max_image_size")
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.Image.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
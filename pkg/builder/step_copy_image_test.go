@@ -0,0 +1,67 @@
+package builder
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+type testImage struct {
+	io.Reader
+	size uint64
+}
+
+func (i *testImage) Close() error         { return nil }
+func (i *testImage) SizeEstimate() uint64 { return i.size }
+
+func TestCheckFreeSpace(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		size, maxSize uint64
+		err, warning  bool
+	}{
+		{name: "small image", size: 1 << 20},
+		{name: "unknown size", size: 0},
+		{name: "unknown size with limit", size: 0, maxSize: 1 << 20},
+		{name: "within limit", size: 1 << 20, maxSize: 1 << 20},
+		{name: "over limit", size: 2 << 20, maxSize: 1 << 20, err: true},
+		// sparse images can be bigger than the free space, so this is only a warning.
+		{name: "bigger than the disk", size: 1 << 62, warning: true},
+		{name: "limit bigger than the disk", size: 0, maxSize: 1 << 62, warning: true},
+	} {
+		var out bytes.Buffer
+		ui := &packer.BasicUi{Writer: &out, ErrorWriter: &out}
+		err := checkFreeSpace(ui, t.TempDir(), &testImage{size: tc.size}, tc.maxSize)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+		if warned := strings.Contains(out.String(), "WARNING"); warned != tc.warning {
+			t.Errorf("%s: unexpected output: %q", tc.name, out.String())
+		}
+	}
+}
+
+func TestLimitedImage(t *testing.T) {
+	data := bytes.Repeat([]byte{1}, 1000)
+	for _, tc := range []struct {
+		limit int64
+		err   bool
+	}{
+		{limit: 999, err: true},
+		{limit: 1000},
+		{limit: 1001},
+	} {
+		img := &limitedImage{Image: &testImage{Reader: bytes.NewReader(data)}, left: tc.limit}
+		read, err := ioutil.ReadAll(img)
+		if (err != nil) != tc.err {
+			t.Errorf("limit %d: unexpected error: %v", tc.limit, err)
+		}
+		if !tc.err && !bytes.Equal(read, data) {
+			t.Errorf("limit %d: read %d bytes, expected %d", tc.limit, len(read), len(data))
+		}
+	}
+}
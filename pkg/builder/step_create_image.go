@@ -0,0 +1,188 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/rekby/mbr"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/gpt"
+)
+
+// partitions start on 1MB boundaries, and the first one starts after the first 1MB.
+const partitionAlignment = 1 << 20
+
+// the well known partition types, for dos and GPT partition tables.
+var partitionTypes = map[string]struct {
+	dos byte
+	gpt string
+}{
+	"linux": {0x83, "0FC63DAF-8483-4772-8E79-3D69D8477DE4"},
+	"fat32": {0x0c, "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7"},
+	"efi":   {0xef, "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"},
+	"swap":  {0x82, "0657FD6D-A4AB-43C4-84E5-0933C84B4F4F"},
+}
+
+func (p ImagePartition) partitionType() string {
+	switch {
+	case p.Type != "":
+		return p.Type
+	case p.Filesystem == "vfat":
+		return "fat32"
+	case p.Filesystem == "swap":
+		return "swap"
+	}
+	return "linux"
+}
+
+func (p ImagePartition) dosType() (byte, error) {
+	t := p.partitionType()
+	if known, ok := partitionTypes[t]; ok {
+		return known.dos, nil
+	}
+	code, err := strconv.ParseUint(strings.TrimPrefix(t, "0x"), 16, 8)
+	if err != nil || code == 0 {
+		return 0, fmt.Errorf("unknown partition type %q for a dos partition table", t)
+	}
+	return byte(code), nil
+}
+
+func (p ImagePartition) gptType() ([16]byte, error) {
+	t := p.partitionType()
+	if known, ok := partitionTypes[t]; ok {
+		t = known.gpt
+	}
+	guid, err := gpt.ParseGUID(t)
+	if err != nil || guid == [16]byte{} {
+		return guid, fmt.Errorf("unknown partition type %q for a GPT partition table", p.partitionType())
+	}
+	return guid, nil
+}
+
+// partitionExtent is the location of a partition on the disk, in sectors.
+type partitionExtent struct {
+	start, sectors uint64
+}
+
+// layoutPartitions places the partitions one after the other from offset (in bytes), and returns
+// the size of the image.
+func layoutPartitions(offset uint64, partitions []ImagePartition, table PartitionTable) ([]partitionExtent, int64) {
+	var extents []partitionExtent
+	offset = (offset + partitionAlignment - 1) / partitionAlignment * partitionAlignment
+	for _, p := range partitions {
+		size := (p.Size + partitionAlignment - 1) / partitionAlignment * partitionAlignment
+		extents = append(extents, partitionExtent{start: offset / gpt.SectorSize, sectors: size / gpt.SectorSize})
+		offset += size
+	}
+	if table == Gpt {
+		// room for the backup GPT.
+		offset += partitionAlignment
+	}
+	return extents, int64(offset)
+}
+
+// stepCreateImage creates an empty image with the partitions in image_partitions.
+type stepCreateImage struct {
+	ResultKey string
+}
+
+func (s *stepCreateImage) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say(fmt.Sprintf("Creating a new image with %d partitions: %s", len(config.ImagePartitions), config.OutputFile))
+	if err := createImage(config.OutputFile, config.PartitionTable, config.ImagePartitions); err != nil {
+		os.Remove(config.OutputFile)
+		err := fmt.Errorf("Error creating image: %v", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Put(s.ResultKey, config.OutputFile)
+	return multistep.ActionContinue
+}
+
+func (s *stepCreateImage) Cleanup(state multistep.StateBag) {
+}
+
+func createImage(path string, table PartitionTable, partitions []ImagePartition) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	extents, size := layoutPartitions(partitionAlignment, partitions, table)
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+
+	// mbr can only read partition tables, start from an empty one.
+	m, _ := mbr.Read(bytes.NewReader(make([]byte, gpt.SectorSize)))
+	m.FixSignature()
+
+	if table == Gpt {
+		t, err := gpt.New(uint64(size) / gpt.SectorSize)
+		if err != nil {
+			return err
+		}
+		if len(partitions) > len(t.Partitions) {
+			return fmt.Errorf("gpt partition tables can't have more than %d partitions", len(t.Partitions))
+		}
+		for i, p := range partitions {
+			typeGUID, err := p.gptType()
+			if err != nil {
+				return err
+			}
+			t.Partitions[i] = gpt.Partition{
+				TypeGUID:    typeGUID,
+				UniqueGUID:  gpt.NewGUID(),
+				StartingLBA: extents[i].start,
+				EndingLBA:   extents[i].start + extents[i].sectors - 1,
+			}
+			t.Partitions[i].SetName(p.Label)
+		}
+		if err := t.Write(f); err != nil {
+			return err
+		}
+		protective := m.GetPartition(1)
+		protective.SetType(mbr.PART_GPT)
+		protective.SetLBAStart(1)
+		return writeProtectiveMbr(f, m, uint64(size)/gpt.SectorSize)
+	}
+
+	if len(partitions) > 4 {
+		return errors.New("dos partition tables can't have more than 4 partitions")
+	}
+	for i, p := range partitions {
+		code, err := p.dosType()
+		if err != nil {
+			return err
+		}
+		if extents[i].start+extents[i].sectors > 0xFFFFFFFF {
+			return errors.New("the image is too big for a dos partition table, use gpt")
+		}
+		part := m.GetPartition(i + 1)
+		part.SetType(mbr.PartitionType(code))
+		part.SetLBAStart(uint32(extents[i].start))
+		part.SetLBALen(uint32(extents[i].sectors))
+	}
+	if err := m.Write(f); err != nil {
+		return err
+	}
+	// a random disk identifier, that PARTUUIDs are made of.
+	id := gpt.NewGUID()
+	_, err = f.WriteAt(id[:4], 440)
+	return err
+}
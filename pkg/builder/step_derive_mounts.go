@@ -0,0 +1,153 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepDeriveMounts finds the mounts of the image when neither image_mounts nor image_mount_specs
+// are set. The /etc/fstab of the largest linux partition, read by stepProbeImage, is resolved
+// against the partitions of the image. If there is no fstab, the mounts of the image type are used.
+type stepDeriveMounts struct {
+	PartitionsKey string
+	ProbeKey      string
+}
+
+func (s *stepDeriveMounts) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	partitions := state.Get(s.PartitionsKey).([]string)
+	ui := state.Get("ui").(packer.Ui)
+
+	if len(partitions) < len(config.ExtraPartitions) {
+		ui.Error(fmt.Sprintf("expected at least %d partitions, found %v", len(config.ExtraPartitions), partitions))
+		return multistep.ActionHalt
+	}
+	probe := state.Get(s.ProbeKey).(*imageProbe)
+	specs, err := s.fromFstab(ctx, state, partitions[:len(partitions)-len(config.ExtraPartitions)], probe)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error deriving the mounts from /etc/fstab: %v", err))
+		return multistep.ActionHalt
+	}
+
+	// the mounts are stored in the config, for stepMountImage.
+	if len(specs) > 0 {
+		for _, spec := range specs {
+			ui.Message(fmt.Sprintf("Mounting %s at %s", spec.Partition, spec.Mountpoint))
+		}
+		config.ImageMountSpecs = specs
+	} else if mounts := knownTypes[config.ImageType]; len(mounts) > 0 {
+		ui.Message(fmt.Sprintf("No /etc/fstab found, using the mounts of %s images: %v", config.ImageType, mounts))
+		config.ImageMounts = mounts
+	} else {
+		ui.Error("no image mounts provided, and there is no /etc/fstab in the image. Please set the image mounts or image type.")
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepDeriveMounts) Cleanup(state multistep.StateBag) {
+}
+
+// fromFstab returns the mounts in the /etc/fstab of the image, or nothing if there is no fstab.
+func (s *stepDeriveMounts) fromFstab(ctx context.Context, state multistep.StateBag, partitions []string, probe *imageProbe) ([]ImageMountSpec, error) {
+	ui := state.Get("ui").(packer.Ui)
+
+	root := probe.root
+	if probe.fstab == nil {
+		return nil, nil
+	}
+	ui.Say(fmt.Sprintf("Using /etc/fstab from %s", root))
+
+	rootSpec := ImageMountSpec{Partition: fmt.Sprint(partitionNumber(root)), Mountpoint: "/"}
+	specs := []ImageMountSpec{rootSpec}
+	used := map[string]bool{root: true}
+	for _, entry := range parseFstab(probe.fstab) {
+		selector, ok := fstabSelector(entry.spec)
+		if !ok {
+			// e.g. proc and tmpfs are not partitions, but devices of other disks should be mentioned.
+			if strings.HasPrefix(entry.spec, "/dev/") {
+				ui.Message(fmt.Sprintf("Not mounting %s at %s: not a partition of the image", entry.spec, entry.mountpoint))
+			}
+			continue
+		}
+		part, err := findPartition(ctx, state, partitions, selector)
+		if err != nil {
+			// e.g. a partition of another disk.
+			ui.Message(fmt.Sprintf("Not mounting %s at %s: %v", entry.spec, entry.mountpoint, err))
+			continue
+		}
+		if entry.mountpoint == "/" {
+			if part != root {
+				// fstab knows better than our guess.
+				delete(used, root)
+				root = part
+				specs[0].Partition = selector
+			}
+			used[part] = true
+			continue
+		}
+		if used[part] {
+			// e.g. btrfs subvolumes, which can't be selected by mount specs.
+			ui.Message(fmt.Sprintf("Not mounting %s at %s: the partition is already mounted", entry.spec, entry.mountpoint))
+			continue
+		}
+		used[part] = true
+		specs = append(specs, ImageMountSpec{Partition: selector, Mountpoint: entry.mountpoint})
+	}
+	return specs, nil
+}
+
+type fstabEntryFields struct {
+	spec, mountpoint string
+}
+
+// parseFstab returns the entries of fstab that mount a filesystem.
+func parseFstab(fstab []byte) []fstabEntryFields {
+	var entries []fstabEntryFields
+	for _, line := range strings.Split(string(fstab), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if !strings.HasPrefix(fields[1], "/") || fields[2] == "swap" {
+			continue
+		}
+		entries = append(entries, fstabEntryFields{spec: fields[0], mountpoint: fields[1]})
+	}
+	return entries
+}
+
+// the /dev/disk links, and the tags they select partitions by.
+var diskLinks = map[string]string{
+	"/dev/disk/by-uuid/":      "UUID",
+	"/dev/disk/by-label/":     "LABEL",
+	"/dev/disk/by-partuuid/":  "PARTUUID",
+	"/dev/disk/by-partlabel/": "PARTLABEL",
+}
+
+// the devices of the disk that an image boots from, e.g. /dev/mmcblk0p2 or /dev/sda2, and
+// their partition number. Devices of other disks are not partitions of the image.
+var bootDiskPartition = regexp.MustCompile(`^/dev/(?:mmcblk0p|nvme0n1p|sda|vda|xvda|hda)([0-9]+)$`)
+
+// fstabSelector converts the device of an fstab entry to the partition of a mount spec. Devices
+// of the boot disk are selected by their partition number, e.g. /dev/mmcblk0p2 is the second
+// partition.
+func fstabSelector(spec string) (string, bool) {
+	if _, _, err := parsePartitionSelector(spec); err == nil && strings.Contains(spec, "=") {
+		return spec, true
+	}
+	for dir, tag := range diskLinks {
+		if strings.HasPrefix(spec, dir) {
+			return tag + "=" + strings.TrimPrefix(spec, dir), true
+		}
+	}
+	if m := bootDiskPartition.FindStringSubmatch(spec); m != nil {
+		return m[1], true
+	}
+	return "", false
+}
@@ -0,0 +1,61 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFstab(t *testing.T) {
+	fstab := `# /etc/fstab: static file system information.
+proc            /proc           proc    defaults          0       0
+PARTUUID=6c586e13-01  /boot/firmware  vfat    defaults          0       2
+PARTUUID=6c586e13-02  /               ext4    defaults,noatime  0       1
+UUID=0a1b none swap sw 0 0
+/swapfile none swap sw 0 0
+tmpfs /tmp tmpfs defaults 0 0
+
+/dev/sdb1 /data
+`
+	expected := []fstabEntryFields{
+		{spec: "proc", mountpoint: "/proc"},
+		{spec: "PARTUUID=6c586e13-01", mountpoint: "/boot/firmware"},
+		{spec: "PARTUUID=6c586e13-02", mountpoint: "/"},
+		{spec: "tmpfs", mountpoint: "/tmp"},
+	}
+	if entries := parseFstab([]byte(fstab)); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("unexpected entries: %+v", entries)
+	}
+}
+
+func TestFstabSelector(t *testing.T) {
+	for _, test := range []struct {
+		spec     string
+		selector string
+		ok       bool
+	}{
+		{"PARTUUID=6c586e13-02", "PARTUUID=6c586e13-02", true},
+		{"LABEL=writable", "LABEL=writable", true},
+		{"UUID=0A1B-2C3D", "UUID=0A1B-2C3D", true},
+		{"/dev/disk/by-partuuid/6c586e13-01", "PARTUUID=6c586e13-01", true},
+		{"/dev/disk/by-label/boot", "LABEL=boot", true},
+		{"/dev/mmcblk0p2", "2", true},
+		{"/dev/sda1", "1", true},
+		{"/dev/vda3", "3", true},
+		{"/dev/nvme0n1p2", "2", true},
+		// other disks
+		{"/dev/sdb1", "", false},
+		{"/dev/mmcblk1p1", "", false},
+		{"/dev/nvme1n1p1", "", false},
+		{"/dev/root", "", false},
+		{"/dev/sda", "", false},
+		// not devices
+		{"proc", "", false},
+		{"tmpfs", "", false},
+		{"server:/export", "", false},
+	} {
+		selector, ok := fstabSelector(test.spec)
+		if selector != test.selector || ok != test.ok {
+			t.Errorf("%s: got %q, %v, expected %q, %v", test.spec, selector, ok, test.selector, test.ok)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/arch"
+)
+
+// the binaries that the architecture of the image is detected from.
+var archBinaries = []string{"/bin/sh", "/sbin/init"}
+
+// stepDetectArch detects the architecture of the image from the ELF header of its binaries. If
+// image_arch is not set, the detected architecture and its qemu binary are used. If it is set and
+// doesn't match the image, the build goes on with a warning.
+type stepDetectArch struct {
+	ChrootKey string
+}
+
+func (s *stepDetectArch) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	chrootDir := state.Get(s.ChrootKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	detected, binary, err := detectArch(chrootDir)
+	switch {
+	case err != nil:
+		ui.Message(fmt.Sprintf("Can't detect the architecture of the image: %v", err))
+	case detected == config.ImageArch:
+		ui.Message(fmt.Sprintf("%s is a %s binary", binary, detected))
+	case config.imageArchSet:
+		ui.Error(fmt.Sprintf("WARNING: image_arch is %s, but %s is a %s binary. "+
+			"Commands in the chroot will likely fail, check image_arch.", config.ImageArch, binary, detected))
+	default:
+		ui.Say(fmt.Sprintf("Detected architecture %s from %s", detected, binary))
+		config.ImageArch = detected
+	}
+	if config.imageArchSet {
+		// the qemu binary was resolved in Prepare.
+		return multistep.ActionContinue
+	}
+
+	warnings, err := config.resolveQemu(false)
+	for _, warning := range warnings {
+		ui.Message(warning)
+	}
+	if err != nil {
+		err := fmt.Errorf("Error finding the qemu binary for %s: %v", config.ImageArch, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepDetectArch) Cleanup(state multistep.StateBag) {
+}
+
+// detectArch returns the architecture of the first binary in archBinaries that is in the chroot.
+func detectArch(chrootDir string) (arch.KnownArchType, string, error) {
+	err := errors.New("no binary found")
+	for _, binary := range archBinaries {
+		var path string
+		path, err = chrootPath(chrootDir, binary)
+		if err != nil {
+			continue
+		}
+		var f *os.File
+		f, err = os.Open(path)
+		if err != nil {
+			continue
+		}
+		detected, elfErr := arch.FromELF(f)
+		f.Close()
+		if err = elfErr; err == nil {
+			return detected, binary, nil
+		}
+	}
+	return arch.Unknown, "", err
+}
+
+// chrootPath resolves the symlinks of path in the chroot, so that absolute links are not resolved
+// on the host.
+func chrootPath(chrootDir, path string) (string, error) {
+	resolved := "/"
+	parts := strings.Split(path, "/")
+	for links := 0; len(parts) > 0; {
+		next := filepath.Join(resolved, parts[0])
+		parts = parts[1:]
+		info, err := os.Lstat(filepath.Join(chrootDir, next))
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > 40 {
+			return "", fmt.Errorf("too many links in %s", path)
+		}
+		target, err := os.Readlink(filepath.Join(chrootDir, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		parts = append(strings.Split(target, "/"), parts...)
+	}
+	return filepath.Join(chrootDir, resolved), nil
+}
@@ -0,0 +1,60 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/utils"
+)
+
+// stepDetectImageType detects the type of the image from its contents, when image_type is not
+// set. The type guessed from the image url is only used when the contents don't tell, and when
+// the image has the partitions of that type.
+type stepDetectImageType struct {
+	PartitionsKey string
+	ProbeKey      string
+	Hint          utils.KnownImageType
+}
+
+func (s *stepDetectImageType) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	partitions := state.Get(s.PartitionsKey).([]string)
+	ui := state.Get("ui").(packer.Ui)
+
+	// the added partitions are empty.
+	if len(partitions) < len(config.ExtraPartitions) {
+		ui.Error(fmt.Sprintf("expected at least %d partitions, found %v", len(config.ExtraPartitions), partitions))
+		return multistep.ActionHalt
+	}
+	partitions = partitions[:len(partitions)-len(config.ExtraPartitions)]
+	probe := state.Get(s.ProbeKey).(*imageProbe)
+
+	imageType, reason := utils.DetectImageType(probe.contents)
+	if imageType == utils.Unknown && s.Hint != utils.Unknown {
+		if len(partitions) >= len(knownTypes[s.Hint]) {
+			imageType, reason = s.Hint, "the image url looks like a "+string(s.Hint)+" image"
+		} else {
+			ui.Message(fmt.Sprintf("The image url looks like a %s image, but the image has %d partitions", s.Hint, len(partitions)))
+		}
+	}
+	if imageType == utils.Unknown {
+		ui.Message("Unknown image type")
+		return multistep.ActionContinue
+	}
+
+	ui.Say(fmt.Sprintf("Detected image type %s: %s", imageType, reason))
+	config.ImageType = imageType
+	if len(config.QemuArgs) == 0 {
+		config.QemuArgs = knownArgs[imageType]
+	}
+	if len(config.QemuArgs) > 0 {
+		// as in Prepare, the image requires custom qemu args, make sure we use qemu
+		config.QemuRequired = true
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepDetectImageType) Cleanup(state multistep.StateBag) {
+}
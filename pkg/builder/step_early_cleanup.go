@@ -0,0 +1,54 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/chroot"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+const earlyCleanupKey = "early_cleanup"
+
+// addEarlyCleanup registers a step that can be cleaned up before the build ends.
+// The cleanups are performed by stepEarlyCleanup, in reverse order of registration.
+func addEarlyCleanup(state multistep.StateBag, c chroot.Cleanup) {
+	var cleanups []chroot.Cleanup
+	if existing, ok := state.GetOk(earlyCleanupKey); ok {
+		cleanups = existing.([]chroot.Cleanup)
+	}
+	state.Put(earlyCleanupKey, append(cleanups, c))
+}
+
+// stepEarlyCleanup unmounts and unmaps the image before the end of the build,
+// so that the image file can be modified further.
+// The regular Cleanup of the registered steps becomes a no-op.
+type stepEarlyCleanup struct{}
+
+func (s *stepEarlyCleanup) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	existing, ok := state.GetOk(earlyCleanupKey)
+	if !ok {
+		return multistep.ActionContinue
+	}
+	cleanups := existing.([]chroot.Cleanup)
+	for len(cleanups) > 0 {
+		var c chroot.Cleanup
+		lastIndex := len(cleanups) - 1
+		c, cleanups = cleanups[lastIndex], cleanups[:lastIndex]
+		state.Put(earlyCleanupKey, cleanups)
+
+		if err := c.CleanupFunc(state); err != nil {
+			err := fmt.Errorf("Error cleaning up: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *stepEarlyCleanup) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,58 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// mkfs commands of the supported filesystems, and their option to set the label.
+var mkfsCommands = map[string]struct{ command, labelFlag string }{
+	"ext2":  {"mkfs.ext2 -F", "-L"},
+	"ext3":  {"mkfs.ext3 -F", "-L"},
+	"ext4":  {"mkfs.ext4 -F", "-L"},
+	"vfat":  {"mkfs.vfat", "-n"},
+	"btrfs": {"mkfs.btrfs -f", "-L"},
+	"xfs":   {"mkfs.xfs -f", "-L"},
+	"f2fs":  {"mkfs.f2fs -f", "-l"},
+	"swap":  {"mkswap", "-L"},
+}
+
+// stepFormatPartitions creates the filesystems of Partitions, which are the last partitions of
+// the image.
+type stepFormatPartitions struct {
+	PartitionsKey string
+	Partitions    []ImagePartition
+}
+
+func (s *stepFormatPartitions) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	partitions := state.Get(s.PartitionsKey).([]string)
+	ui := state.Get("ui").(packer.Ui)
+
+	if len(partitions) < len(s.Partitions) {
+		ui.Error(fmt.Sprintf("expected %d partitions, found %v", len(s.Partitions), partitions))
+		return multistep.ActionHalt
+	}
+	partitions = partitions[len(partitions)-len(s.Partitions):]
+
+	for i, p := range s.Partitions {
+		if p.Filesystem == "" {
+			continue
+		}
+		mkfs := mkfsCommands[p.Filesystem]
+		cmd := mkfs.command
+		if p.Label != "" {
+			cmd += fmt.Sprintf(" %s '%s'", mkfs.labelFlag, p.Label)
+		}
+		ui.Message(fmt.Sprintf("Creating %s filesystem on %s", p.Filesystem, partitions[i]))
+		if err := run(ctx, state, cmd+" "+partitions[i]); err != nil {
+			return multistep.ActionHalt
+		}
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepFormatPartitions) Cleanup(state multistep.StateBag) {
+}
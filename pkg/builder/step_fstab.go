@@ -0,0 +1,110 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepAddFstabEntries adds /etc/fstab entries in the chroot for Partitions, which are the last
+// partitions of the image. The partitions are identified by the UUID of their filesystem.
+type stepAddFstabEntries struct {
+	PartitionsKey string
+	ChrootKey     string
+	Partitions    []ImagePartition
+}
+
+func (s *stepAddFstabEntries) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	partitions := state.Get(s.PartitionsKey).([]string)
+	mountPath := state.Get(s.ChrootKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	if len(partitions) < len(s.Partitions) {
+		ui.Error(fmt.Sprintf("expected %d partitions, found %v", len(s.Partitions), partitions))
+		return multistep.ActionHalt
+	}
+	partitions = partitions[len(partitions)-len(s.Partitions):]
+
+	fstab := filepath.Join(mountPath, "etc", "fstab")
+	existing, err := ioutil.ReadFile(fstab)
+	if err != nil && !os.IsNotExist(err) {
+		ui.Error(fmt.Sprintf("Error reading /etc/fstab: %v", err))
+		return multistep.ActionHalt
+	}
+	mounted := map[string]bool{}
+	for _, line := range strings.Split(string(existing), "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && !strings.HasPrefix(fields[0], "#") {
+			mounted[fields[1]] = true
+		}
+	}
+
+	var entries []string
+	for i, p := range s.Partitions {
+		mountpoint := p.Mountpoint
+		if p.Filesystem == "swap" {
+			mountpoint = "none"
+		}
+		if p.Filesystem == "" || mountpoint == "" {
+			continue
+		}
+		if mountpoint != "none" && mounted[mountpoint] {
+			ui.Message(fmt.Sprintf("/etc/fstab already has an entry for %s, not adding one", mountpoint))
+			continue
+		}
+
+		tags, err := probePartition(ctx, state, partitions[i])
+		if err != nil {
+			return multistep.ActionHalt
+		}
+		if tags["UUID"] == "" {
+			ui.Error(fmt.Sprintf("no filesystem UUID found on %s", partitions[i]))
+			return multistep.ActionHalt
+		}
+		entries = append(entries, fstabEntry("UUID="+tags["UUID"], mountpoint, p.Filesystem))
+	}
+	if len(entries) == 0 {
+		return multistep.ActionContinue
+	}
+
+	ui.Say(fmt.Sprintf("Adding %d entries to /etc/fstab", len(entries)))
+	if err := os.MkdirAll(filepath.Dir(fstab), 0755); err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	f, err := os.OpenFile(fstab, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error opening /etc/fstab: %v", err))
+		return multistep.ActionHalt
+	}
+	defer f.Close()
+	if len(existing) > 0 && !strings.HasSuffix(string(existing), "\n") {
+		entries[0] = "\n" + entries[0]
+	}
+	if _, err := f.WriteString(strings.Join(entries, "\n") + "\n"); err != nil {
+		ui.Error(fmt.Sprintf("Error writing /etc/fstab: %v", err))
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepAddFstabEntries) Cleanup(state multistep.StateBag) {
+}
+
+func fstabEntry(spec, mountpoint, filesystem string) string {
+	switch {
+	case filesystem == "swap":
+		return fmt.Sprintf("%s none swap sw 0 0", spec)
+	case mountpoint == "/":
+		return fmt.Sprintf("%s / %s defaults 0 1", spec, filesystem)
+	case filesystem == "btrfs" || filesystem == "xfs":
+		// these filesystems are checked when they are mounted.
+		return fmt.Sprintf("%s %s %s defaults 0 0", spec, mountpoint, filesystem)
+	}
+	return fmt.Sprintf("%s %s %s defaults 0 2", spec, mountpoint, filesystem)
+}
@@ -0,0 +1,67 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/utils"
+)
+
+// stepInPlaceImage uses the source image as the output image, without copying it. The image
+// is locked until the end of the build, so that two builds don't modify it at the same time.
+type stepInPlaceImage struct {
+	ResultKey   string
+	ImageOpener image.ImageOpener
+
+	file *os.File
+}
+
+func (s *stepInPlaceImage) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	path, _ := localPath(config.ISOUrls[0])
+	if err := s.lock(path); err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ui.Say(fmt.Sprintf("Modifying the source image in place: %s", path))
+	state.Put(s.ResultKey, path)
+	return multistep.ActionContinue
+}
+
+func (s *stepInPlaceImage) lock(path string) error {
+	img, err := s.ImageOpener.Open(path)
+	if err != nil {
+		return err
+	}
+	_, raw := img.(image.RawImage)
+	img.Close()
+	if !raw {
+		return fmt.Errorf("in_place requires a raw image, %s is compressed or in another format", path)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := utils.LockFile(f); err != nil {
+		f.Close()
+		return fmt.Errorf("can't lock %s, is it used by another build? %v", path, err)
+	}
+	s.file = f
+	return nil
+}
+
+func (s *stepInPlaceImage) Cleanup(state multistep.StateBag) {
+	// closing the file releases the lock.
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
@@ -54,6 +54,7 @@ func (s *stepMapImage) Run(_ context.Context, state multistep.StateBag) multiste
 	cPartitions := make(chan []string)
 	action := make(chan multistep.StepAction)
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	go func() {
 		for {
 			select {
@@ -100,21 +101,30 @@ func (s *stepMapImage) Run(_ context.Context, state multistep.StateBag) multiste
 	}
 
 	state.Put(s.ResultKey, partitions)
+	addEarlyCleanup(state, s)
 
 	return multistep.ActionContinue
 }
 
 func (s *stepMapImage) Cleanup(state multistep.StateBag) {
+	// errors are reported by run()
+	s.CleanupFunc(state)
+}
+
+func (s *stepMapImage) CleanupFunc(state multistep.StateBag) error {
+	var err error
 	switch partitions := state.Get(s.ResultKey).(type) {
 	case nil:
-		return
+		return nil
 	case []string:
 		if len(partitions) > 0 {
 			// Convert /dev/loop10p1 into /dev/loop10
 			loop := loopRe.Find([]byte(partitions[0]))
 			if loop != nil {
-				run(context.TODO(), state, fmt.Sprintf("losetup -d %s", string(loop)))
+				err = run(context.TODO(), state, fmt.Sprintf("losetup -d %s", string(loop)))
 			}
 		}
 	}
+	state.Remove(s.ResultKey)
+	return err
 }
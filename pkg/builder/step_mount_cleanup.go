@@ -4,6 +4,7 @@ package builder
 import (
 	"context"
 
+	"github.com/hashicorp/packer-plugin-sdk/chroot"
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 )
@@ -16,13 +17,22 @@ type StepMountCleanup struct {
 }
 
 func (s *StepMountCleanup) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	// the extra mounts need to be unmounted before the image is, and after processes in the chroot are killed.
+	if c, ok := state.GetOk("mount_extra_cleanup"); ok {
+		addEarlyCleanup(state, c.(chroot.Cleanup))
+	}
+	addEarlyCleanup(state, s)
 	return multistep.ActionContinue
 }
 
 func (s *StepMountCleanup) Cleanup(state multistep.StateBag) {
+	s.CleanupFunc(state)
+}
+
+func (s *StepMountCleanup) CleanupFunc(state multistep.StateBag) error {
 	mountPath := state.Get("mount_path").(string)
 
 	ui := state.Get("ui").(packer.Ui)
 	ui.Say("fuser -k " + mountPath)
-	run(context.TODO(), state, "fuser -k "+mountPath+" || exit 0")
+	return run(context.TODO(), state, "fuser -k "+mountPath+" || exit 0")
 }
@@ -8,6 +8,8 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
@@ -29,9 +31,9 @@ func (s *stepMountImage) Run(ctx context.Context, state multistep.StateBag) mult
 	ui := state.Get("ui").(packer.Ui)
 	ui.Say(fmt.Sprintf("partitions: %v", partitions))
 
-	// assume first one is boot and second one is root!
-	if len(partitions) != len(config.ImageMounts) {
-		ui.Error(fmt.Sprintf("error different of partitions than expected %v", len(partitions)))
+	mountsAndPartitions, err := s.mounts(ctx, state, config, partitions)
+	if err != nil {
+		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
@@ -51,12 +53,6 @@ func (s *stepMountImage) Run(ctx context.Context, state multistep.StateBag) mult
 	}
 	log.Println("mounting to", s.MountPath)
 
-	mountsAndPartitions := make([]struct{ part, mnt string }, len(partitions))
-	for i := range partitions {
-		mountsAndPartitions[i].part = partitions[i]
-		mountsAndPartitions[i].mnt = config.ImageMounts[i]
-	}
-
 	// sort so we mount with the right order
 	// sort that / is mounted before /boot
 	sort.Slice(mountsAndPartitions, func(i, j int) bool { return mountsAndPartitions[i].mnt < mountsAndPartitions[j].mnt })
@@ -69,6 +65,11 @@ func (s *stepMountImage) Run(ctx context.Context, state multistep.StateBag) mult
 		mntpnt := filepath.Join(s.MountPath, mntAndPart.mnt)
 
 		ui.Message(fmt.Sprintf("Mounting: %s", mntAndPart.part))
+		// the mount point may be missing in a new, empty filesystem.
+		if err := os.MkdirAll(mntpnt, 0755); err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
 
 		err := run(ctx, state, fmt.Sprintf(
 			"mount %s %s",
@@ -81,28 +82,130 @@ func (s *stepMountImage) Run(ctx context.Context, state multistep.StateBag) mult
 	}
 
 	state.Put(s.ResultKey, s.MountPath)
+	addEarlyCleanup(state, s)
 
 	updateGeneratedData(state, s.GeneratedDataKey, s.MountPath)
 
 	return multistep.ActionContinue
 }
 
-func (s *stepMountImage) Cleanup(state multistep.StateBag) {
-	ui := state.Get("ui").(packer.Ui)
+type partitionMount struct{ part, mnt string }
+
+// mounts pairs the partitions with their mount points. The partitions are selected by
+// image_mount_specs, or by their position in image_mounts. The partitions added by
+// extra_partitions come last, and are mounted at their mountpoint.
+func (s *stepMountImage) mounts(ctx context.Context, state multistep.StateBag, config *Config, partitions []string) ([]partitionMount, error) {
+	if len(partitions) < len(config.ExtraPartitions) {
+		return nil, fmt.Errorf("expected at least %d partitions, found %v", len(config.ExtraPartitions), partitions)
+	}
+	imageParts := partitions[:len(partitions)-len(config.ExtraPartitions)]
+
+	var mounts []partitionMount
+	if len(config.ImageMountSpecs) > 0 {
+		for _, spec := range config.ImageMountSpecs {
+			part, err := findPartition(ctx, state, imageParts, spec.Partition)
+			if err != nil {
+				return nil, err
+			}
+			mounts = append(mounts, partitionMount{part: part, mnt: spec.Mountpoint})
+		}
+	} else {
+		// the image may have more partitions than mounts, the last ones are not mounted.
+		if len(imageParts) < len(config.ImageMounts) {
+			return nil, fmt.Errorf("the image has %d partitions, but image_mounts has %d entries", len(imageParts), len(config.ImageMounts))
+		}
+		for i, mnt := range config.ImageMounts {
+			mounts = append(mounts, partitionMount{part: imageParts[i], mnt: mnt})
+		}
+	}
+
+	for i, p := range config.ExtraPartitions {
+		mounts = append(mounts, partitionMount{part: partitions[len(imageParts)+i], mnt: p.Mountpoint})
+	}
+	return mounts, nil
+}
 
-	if s.MountPath != "" {
-		for _, mntpnt := range reverse(s.mountpoints) {
-			run(context.TODO(), state, "umount "+mntpnt)
+// parsePartitionSelector parses the partition of a mount spec: a partition number, or a
+// PARTLABEL=, PARTUUID=, LABEL=, UUID= or TYPE= tag, as reported by blkid.
+func parsePartitionSelector(selector string) (tag, value string, err error) {
+	if n, err := strconv.Atoi(selector); err == nil {
+		if n < 1 {
+			return "", "", fmt.Errorf("bad partition number %d", n)
 		}
-		s.mountpoints = nil
-		// DO NOT do remove all here! if dev fails to umount it would be undesirable.
-		err := os.Remove(s.MountPath)
+		return "", selector, nil
+	}
+	tag, value, ok := strings.Cut(selector, "=")
+	switch tag {
+	case "PARTLABEL", "PARTUUID", "LABEL", "UUID", "TYPE":
+		if ok && value != "" {
+			return tag, value, nil
+		}
+	}
+	return "", "", fmt.Errorf("bad partition %q, expected a number or one of PARTLABEL=, PARTUUID=, LABEL=, UUID=, TYPE=", selector)
+}
+
+// findPartition returns the only partition that matches selector.
+func findPartition(ctx context.Context, state multistep.StateBag, partitions []string, selector string) (string, error) {
+	tag, value, err := parsePartitionSelector(selector)
+	if err != nil {
+		return "", err
+	}
+
+	var found []string
+	for _, part := range partitions {
+		if tag == "" {
+			if strconv.Itoa(partitionNumber(part)) == value {
+				found = append(found, part)
+			}
+			continue
+		}
+		tags, err := probePartition(ctx, state, part)
 		if err != nil {
-			ui.Error(err.Error())
+			return "", err
+		}
+		// UUIDs are printed in lower case, but may be written in upper case.
+		if tags[tag] == value || (strings.HasSuffix(tag, "UUID") && strings.EqualFold(tags[tag], value)) {
+			found = append(found, part)
 		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no partition matches %s", selector)
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%s matches more than one partition: %v", selector, found)
+}
+
+func (s *stepMountImage) Cleanup(state multistep.StateBag) {
+	ui := state.Get("ui").(packer.Ui)
+
+	if err := s.CleanupFunc(state); err != nil {
+		ui.Error(err.Error())
+	}
+}
+
+func (s *stepMountImage) CleanupFunc(state multistep.StateBag) error {
+	if s.MountPath == "" {
+		return nil
+	}
+
+	var umountErr error
+	for _, mntpnt := range reverse(s.mountpoints) {
+		if err := run(context.TODO(), state, "umount "+mntpnt); err != nil && umountErr == nil {
+			umountErr = err
+		}
+	}
+	s.mountpoints = nil
+	// DO NOT do remove all here! if dev fails to umount it would be undesirable.
+	err := os.Remove(s.MountPath)
+	s.MountPath = ""
 
-		s.MountPath = ""
+	if umountErr != nil {
+		return umountErr
 	}
+	return err
 }
 
 func reverse(numbers []string) []string {
@@ -0,0 +1,100 @@
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	packer_common_common "github.com/hashicorp/packer-plugin-sdk/common"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+func TestParsePartitionSelector(t *testing.T) {
+	for _, tc := range []struct {
+		selector, tag, value string
+		err                  bool
+	}{
+		{selector: "1", value: "1"},
+		{selector: "12", value: "12"},
+		{selector: "LABEL=rootfs", tag: "LABEL", value: "rootfs"},
+		{selector: "UUID=1234-ABCD", tag: "UUID", value: "1234-ABCD"},
+		{selector: "PARTUUID=6c586e13-02", tag: "PARTUUID", value: "6c586e13-02"},
+		{selector: "PARTLABEL=system_a", tag: "PARTLABEL", value: "system_a"},
+		{selector: "TYPE=vfat", tag: "TYPE", value: "vfat"},
+		{selector: "LABEL=with=equals", tag: "LABEL", value: "with=equals"},
+		{selector: "0", err: true},
+		{selector: "-1", err: true},
+		{selector: "", err: true},
+		{selector: "rootfs", err: true},
+		{selector: "LABEL=", err: true},
+		{selector: "LABEL", err: true},
+		{selector: "label=rootfs", err: true},
+		{selector: "SIZE=1G", err: true},
+	} {
+		tag, value, err := parsePartitionSelector(tc.selector)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: unexpected error: %v", tc.selector, err)
+			continue
+		}
+		if tag != tc.tag || value != tc.value {
+			t.Errorf("%q: got %q, %q, expected %q, %q", tc.selector, tag, value, tc.tag, tc.value)
+		}
+	}
+}
+
+// blkidState returns a state whose commands print the blkid tags of the partitions, instead of
+// probing real devices.
+func blkidState(tags map[string]string) multistep.StateBag {
+	state := new(multistep.BasicStateBag)
+	state.Put("ui", &packer.BasicUi{Writer: ioutil.Discard, ErrorWriter: ioutil.Discard})
+	state.Put("wrappedCommand", packer_common_common.CommandWrapper(func(cmd string) (string, error) {
+		for dev, out := range tags {
+			if strings.HasPrefix(cmd, "blkid ") && strings.Contains(cmd, " "+dev+" ") {
+				return "printf %s " + shellQuote(out), nil
+			}
+		}
+		// nothing detected.
+		return "true", nil
+	}))
+	return state
+}
+
+func TestFindPartition(t *testing.T) {
+	partitions := []string{"/dev/loop0p1", "/dev/loop0p2", "/dev/loop0p3"}
+	state := blkidState(map[string]string{
+		"/dev/loop0p1": "LABEL=boot\nUUID=1234-ABCD\nTYPE=vfat\nPARTUUID=6c586e13-01\n",
+		"/dev/loop0p2": "LABEL=my\\ root\nUUID=0b3c4a9e-7f1d-4d2a-9c0e-5a6b7c8d9e0f\nTYPE=ext4\nPARTUUID=6c586e13-02\n",
+		"/dev/loop0p3": "LABEL=data\nUUID=f3e1c2d4-0000-4000-8000-000000000000\nTYPE=ext4\nPARTUUID=6c586e13-03\n",
+	})
+
+	for _, tc := range []struct {
+		selector, found string
+		err             bool
+	}{
+		{selector: "1", found: "/dev/loop0p1"},
+		{selector: "3", found: "/dev/loop0p3"},
+		{selector: "4", err: true},
+		{selector: "LABEL=boot", found: "/dev/loop0p1"},
+		{selector: "LABEL=my root", found: "/dev/loop0p2"},
+		// labels are case sensitive, UUIDs are not.
+		{selector: "LABEL=BOOT", err: true},
+		{selector: "UUID=1234-abcd", found: "/dev/loop0p1"},
+		{selector: "UUID=0B3C4A9E-7F1D-4D2A-9C0E-5A6B7C8D9E0F", found: "/dev/loop0p2"},
+		{selector: "PARTUUID=6C586E13-03", found: "/dev/loop0p3"},
+		{selector: "TYPE=vfat", found: "/dev/loop0p1"},
+		{selector: "TYPE=ext4", err: true},
+		{selector: "TYPE=btrfs", err: true},
+		{selector: "rootfs", err: true},
+	} {
+		found, err := findPartition(context.Background(), state, partitions, tc.selector)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: unexpected error: %v", tc.selector, err)
+			continue
+		}
+		if found != tc.found {
+			t.Errorf("%q: found %q, expected %q", tc.selector, found, tc.found)
+		}
+	}
+}
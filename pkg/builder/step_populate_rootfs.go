@@ -0,0 +1,43 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepPopulateRootfs copies rootfs_source into the mounted partitions of a new image. It runs
+// before the chroot mounts, so that nothing is copied into /dev or /proc of the host.
+type stepPopulateRootfs struct {
+	ChrootKey string
+}
+
+func (s *stepPopulateRootfs) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	mountPath := state.Get(s.ChrootKey).(string)
+	ui := state.Get("ui").(packer.Ui)
+
+	info, err := os.Stat(config.RootfsSource)
+	if err != nil {
+		err := fmt.Errorf("Error reading rootfs_source: %v", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ui.Say(fmt.Sprintf("Copying the root filesystem from %s", config.RootfsSource))
+	cmd := fmt.Sprintf("tar --numeric-owner --xattrs --xattrs-include='*' -xpf %s -C %s", shellQuote(config.RootfsSource), shellQuote(mountPath))
+	if info.IsDir() {
+		cmd = fmt.Sprintf("cp -a %s %s", shellQuote(config.RootfsSource+"/."), shellQuote(mountPath))
+	}
+	if err := run(ctx, state, cmd); err != nil {
+		return multistep.ActionHalt
+	}
+	return multistep.ActionContinue
+}
+
+func (s *stepPopulateRootfs) Cleanup(state multistep.StateBag) {
+}
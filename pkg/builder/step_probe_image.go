@@ -0,0 +1,165 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/utils"
+)
+
+// filesystems that a linux root filesystem can be on.
+var rootFilesystems = map[string]bool{"ext2": true, "ext3": true, "ext4": true, "btrfs": true, "xfs": true, "f2fs": true}
+
+// imageProbe is what stepDetectImageType and stepDeriveMounts need from the partitions of the
+// image, read by mounting each partition once.
+type imageProbe struct {
+	contents utils.ImageContents
+	// root is the largest linux partition, and fstab its /etc/fstab, nil if it has none.
+	root  string
+	fstab []byte
+}
+
+// stepProbeImage mounts the partitions of the image read-only, one at a time, and stores what
+// they hold in ResultKey. The partitions added by extra_partitions are empty, and not probed.
+type stepProbeImage struct {
+	PartitionsKey string
+	ResultKey     string
+}
+
+func (s *stepProbeImage) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	partitions := state.Get(s.PartitionsKey).([]string)
+	ui := state.Get("ui").(packer.Ui)
+
+	if len(partitions) < len(config.ExtraPartitions) {
+		ui.Error(fmt.Sprintf("expected at least %d partitions, found %v", len(config.ExtraPartitions), partitions))
+		return multistep.ActionHalt
+	}
+	probe, err := probeImage(ctx, state, partitions[:len(partitions)-len(config.ExtraPartitions)])
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error reading the partitions of the image: %v", err))
+		return multistep.ActionHalt
+	}
+	state.Put(s.ResultKey, probe)
+	return multistep.ActionContinue
+}
+
+func (s *stepProbeImage) Cleanup(state multistep.StateBag) {
+}
+
+// probeImage reads the boot files of the FAT partitions, the release files of the linux
+// partitions, and the fstab of the root filesystem.
+func probeImage(ctx context.Context, state multistep.StateBag, partitions []string) (*imageProbe, error) {
+	probe := &imageProbe{contents: utils.ImageContents{BootFiles: map[string]bool{}, OsRelease: map[string]string{}}}
+
+	types := map[string]string{}
+	var rootSize int64
+	for _, part := range partitions {
+		tags, err := probePartition(ctx, state, part)
+		if err != nil {
+			return nil, err
+		}
+		types[part] = tags["TYPE"]
+		if !rootFilesystems[tags["TYPE"]] {
+			continue
+		}
+		size, err := deviceSize(part)
+		if err != nil {
+			return nil, err
+		}
+		if size > rootSize {
+			probe.root, rootSize = part, size
+		}
+	}
+
+	for _, part := range partitions {
+		var err error
+		switch {
+		case types[part] == "vfat":
+			err = withPartitionMounted(ctx, state, part, func(mnt string) error {
+				files, err := ioutil.ReadDir(mnt)
+				for _, f := range files {
+					probe.contents.BootFiles[strings.ToLower(f.Name())] = true
+				}
+				return err
+			})
+		case rootFilesystems[types[part]]:
+			err = withPartitionMounted(ctx, state, part, func(mnt string) error {
+				if err := readReleaseFiles(mnt, &probe.contents); err != nil {
+					return err
+				}
+				if part != probe.root {
+					return nil
+				}
+				fstab, err := ioutil.ReadFile(filepath.Join(mnt, "etc", "fstab"))
+				if os.IsNotExist(err) {
+					return nil
+				}
+				probe.fstab = fstab
+				return err
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return probe, nil
+}
+
+// readReleaseFiles reads the release files of the linux filesystem mounted at mnt.
+func readReleaseFiles(mnt string, contents *utils.ImageContents) error {
+	if _, err := os.Stat(filepath.Join(mnt, "etc", "armbian-release")); err == nil {
+		contents.ArmbianRelease = true
+	}
+	path := filepath.Join(mnt, "etc", "os-release")
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		// the link may be absolute, and resolved on the host.
+		path = filepath.Join(mnt, "usr", "lib", "os-release")
+	}
+	osRelease, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for k, v := range utils.ParseOsRelease(osRelease) {
+		contents.OsRelease[k] = v
+	}
+	return nil
+}
+
+// withPartitionMounted mounts a partition read-only in a temporary directory, for f.
+func withPartitionMounted(ctx context.Context, state multistep.StateBag, part string, f func(mnt string) error) error {
+	mnt, err := ioutil.TempDir("", "armimg-probe-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mnt)
+
+	if err := run(ctx, state, fmt.Sprintf("mount -o ro %s %s", part, mnt)); err != nil {
+		return err
+	}
+	err = f(mnt)
+	if umountErr := run(ctx, state, "umount "+mnt); umountErr != nil {
+		return errors.New("can't unmount " + part)
+	}
+	return err
+}
+
+// deviceSize returns the size of a block device.
+func deviceSize(dev string) (int64, error) {
+	f, err := os.Open(dev)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.Seek(0, io.SeekEnd)
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/utils"
 )
 
 const wrapped = "-wrapped"
@@ -20,9 +21,13 @@ type Args struct {
 	PathToQemuInChroot string
 }
 
+// stepQemuUserStatic makes qemu available to the binaries in the chroot. When the kernel supports
+// the binfmt_misc F flag, qemu is opened from the host when it is registered, and nothing is
+// placed in the image. Otherwise, or when qemu needs arguments, it is copied in the chroot.
 type stepQemuUserStatic struct {
 	ChrootKey             string
 	PathToQemuInChrootKey string
+	FixBinaryKey          string
 
 	Args                    Args
 	qemuDestinationInChroot string
@@ -57,12 +62,26 @@ func (s *stepQemuUserStatic) Run(ctx context.Context, state multistep.StateBag)
 	// Read our value and assert that it is they type we want
 	chrootDir := state.Get(s.ChrootKey).(string)
 	config := state.Get("config").(*Config)
+	if !config.qemuNeeded() {
+		// the image turned out to be native.
+		return multistep.ActionContinue
+	}
 
 	ui := state.Get("ui").(packer.Ui)
-	ui.Say(fmt.Sprintf("Installing qemu-user-static (%s) in the chroot", config.QemuBinary))
 	qemuInHostPath := config.QemuBinary
-	_, qemuFilename := filepath.Split(qemuInHostPath)
 
+	// the args of a detected image type are only known now.
+	s.Args.Args = config.QemuArgs
+	// the args wrapper runs qemu from the chroot.
+	if len(s.Args.Args) == 0 && utils.BinfmtFixBinarySupported() {
+		ui.Say(fmt.Sprintf("Using qemu-user-static (%s) from the host", qemuInHostPath))
+		state.Put(s.PathToQemuInChrootKey, qemuInHostPath)
+		state.Put(s.FixBinaryKey, true)
+		return multistep.ActionContinue
+	}
+
+	ui.Say(fmt.Sprintf("Installing qemu-user-static (%s) in the chroot", qemuInHostPath))
+	_, qemuFilename := filepath.Split(qemuInHostPath)
 	// place qemu in the root dir in the chroot, as it is guaranteed to exist
 	s.Args.PathToQemuInChroot = "/" + qemuFilename
 
@@ -78,6 +97,7 @@ func (s *stepQemuUserStatic) Run(ctx context.Context, state multistep.StateBag)
 	if err != nil {
 		return multistep.ActionHalt
 	}
+	addEarlyCleanup(state, s)
 	return multistep.ActionContinue
 }
 
@@ -128,10 +148,20 @@ func (s *stepQemuUserStatic) makeWrapper(ctx context.Context, ui packer.Ui, stat
 }
 
 func (s *stepQemuUserStatic) Cleanup(state multistep.StateBag) {
+	s.CleanupFunc(state)
+}
+
+func (s *stepQemuUserStatic) CleanupFunc(state multistep.StateBag) error {
+	var err error
 	if s.qemuDestinationInChroot != "" {
-		os.Remove(s.qemuDestinationInChroot)
+		err = os.Remove(s.qemuDestinationInChroot)
+		s.qemuDestinationInChroot = ""
 	}
 	if s.destWrapper != "" {
-		os.Remove(s.destWrapper)
+		if werr := os.Remove(s.destWrapper); err == nil {
+			err = werr
+		}
+		s.destWrapper = ""
 	}
+	return err
 }
@@ -2,79 +2,271 @@ package builder
 
 import (
 	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/arch"
 )
 
-const namePrefix = "packer-plugin-arm-image-"
+const (
+	namePrefix = "packer-plugin-arm-image-"
+	binfmtMisc = "/proc/sys/fs/binfmt_misc"
+)
 
+// stepRegisterBinFmt registers qemu with binfmt_misc, for the binaries of the image. A compatible
+// handler that the host already has, e.g. from qemu-user-static, is used instead if there is one.
 type stepRegisterBinFmt struct {
-	QemuPathKey string
-	BinfmtName string
+	ChrootKey    string
+	QemuPathKey  string
+	FixBinaryKey string
+	BinfmtName   string
 }
 
 // this info can be obtrained with
 // /usr/sbin/update-binfmts --display qemu-aarch64
+// or from scripts/qemu-binfmt-conf.sh in the qemu sources.
+// The masks ignore the ELF OS/ABI, and allow both executables and shared objects.
 const (
-	mask               = `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`
-	qemu_arm_magic     = `\x7f\x45\x4c\x46\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00`
-	qemu_aarch64_magic = `\x7f\x45\x4c\x46\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00`
+	maskLE  = `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`
+	maskBE  = `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff`
+	maskX86 = `\xff\xff\xff\xff\xff\xfe\xfe\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`
 )
 
+type binfmt struct {
+	magic string
+	mask  string
+	flags string
+}
+
+// the binfmt_misc registration of the binaries of each architecture.
+var binfmts = map[arch.KnownArchType]binfmt{
+	arch.Arm:      {magic: `\x7f\x45\x4c\x46\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00`, mask: maskLE},
+	arch.ArmBE:    {magic: `\x7f\x45\x4c\x46\x01\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28`, mask: maskBE},
+	arch.Arm64:    {magic: `\x7f\x45\x4c\x46\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00`, mask: maskLE},
+	arch.Arm64BE:  {magic: `\x7f\x45\x4c\x46\x02\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7`, mask: maskBE},
+	arch.Riscv64:  {magic: `\x7f\x45\x4c\x46\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xf3\x00`, mask: maskLE},
+	arch.I386:     {magic: `\x7f\x45\x4c\x46\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x03\x00`, mask: maskX86},
+	arch.Amd64:    {magic: `\x7f\x45\x4c\x46\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x3e\x00`, mask: maskX86},
+	arch.Mips:     {magic: `\x7f\x45\x4c\x46\x01\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x08`, mask: maskBE},
+	arch.MipsLE:   {magic: `\x7f\x45\x4c\x46\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x08\x00`, mask: maskLE},
+	arch.Mips64:   {magic: `\x7f\x45\x4c\x46\x02\x02\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x08`, mask: maskBE},
+	arch.Mips64LE: {magic: `\x7f\x45\x4c\x46\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x08\x00`, mask: maskLE},
+}
+
+// binfmtRegistration returns the string that registers interpreter with binfmt_misc as name, for
+// the binaries of the architecture. With fixBinary, the kernel opens the interpreter when it is
+// registered, so that it doesn't have to be in the chroot.
+func binfmtRegistration(name string, imageArch arch.KnownArchType, interpreter string, fixBinary bool) (string, error) {
+	b, ok := binfmts[imageArch]
+	if !ok {
+		return "", fmt.Errorf("unknown binfmt_misc magic for architecture %q", imageArch)
+	}
+	flags := b.flags
+	if fixBinary {
+		flags += "F"
+	}
+	return fmt.Sprintf(":%s:M::%s:%s:%s:%s", name, b.magic, b.mask, interpreter, flags), nil
+}
+
+// binfmtBytes returns the bytes of an escaped magic or mask.
+func binfmtBytes(escaped string) []byte {
+	var b []byte
+	for _, h := range strings.Split(escaped, `\x`)[1:] {
+		v, _ := strconv.ParseUint(h, 16, 8)
+		b = append(b, byte(v))
+	}
+	return b
+}
+
+// binfmtHandler is a handler registered with binfmt_misc.
+type binfmtHandler struct {
+	name        string
+	enabled     bool
+	interpreter string
+	flags       string
+	offset      int
+	magic       []byte
+	mask        []byte
+}
+
+// parseBinfmtHandler parses a file of /proc/sys/fs/binfmt_misc, e.g.
+//
+//	enabled
+//	interpreter /usr/bin/qemu-aarch64-static
+//	flags: F
+//	offset 0
+//	magic 7f454c460201010000000000000000000200b700
+//	mask ffffffffffffff00fffffffffffffffffeffffff
+func parseBinfmtHandler(name string, data []byte) (*binfmtHandler, error) {
+	h := &binfmtHandler{name: name}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		var err error
+		switch key {
+		case "enabled":
+			h.enabled = true
+		case "interpreter":
+			h.interpreter = value
+		case "flags:":
+			h.flags = value
+		case "offset":
+			h.offset, err = strconv.Atoi(value)
+		case "magic":
+			h.magic, err = hex.DecodeString(value)
+		case "mask":
+			h.mask, err = hex.DecodeString(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad %s in binfmt_misc handler %s: %v", key, name, err)
+		}
+	}
+	return h, nil
+}
+
+// matches returns whether the handler runs the binaries that start with header.
+func (h *binfmtHandler) matches(header []byte) bool {
+	if !h.enabled || h.offset != 0 || len(h.magic) == 0 || len(h.magic) > len(header) {
+		return false
+	}
+	for i := range h.magic {
+		mask := byte(0xff)
+		if i < len(h.mask) {
+			mask = h.mask[i]
+		}
+		if (header[i]^h.magic[i])&mask != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// usableIn returns whether the interpreter of the handler can be run from the chroot. It has to
+// be in the chroot, unless the kernel opened it when it was registered.
+func (h *binfmtHandler) usableIn(chrootDir string) bool {
+	if strings.Contains(h.flags, "F") {
+		return true
+	}
+	path, err := chrootPath(chrootDir, h.interpreter)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// findBinfmtHandler returns a handler of the host for the binaries of the architecture, or nil.
+// The handlers of other builds are not used, as they go away when those builds end.
+func findBinfmtHandler(chrootDir string, imageArch arch.KnownArchType) (*binfmtHandler, error) {
+	b, ok := binfmts[imageArch]
+	if !ok {
+		return nil, fmt.Errorf("unknown binfmt_misc magic for architecture %q", imageArch)
+	}
+	header := binfmtBytes(b.magic)
+
+	files, err := ioutil.ReadDir(binfmtMisc)
+	if err != nil {
+		// registering fails as well, with a better error.
+		log.Printf("can't list the binfmt_misc handlers: %v", err)
+		return nil, nil
+	}
+	for _, f := range files {
+		if f.Name() == "register" || f.Name() == "status" || strings.HasPrefix(f.Name(), namePrefix) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(binfmtMisc, f.Name()))
+		if err != nil {
+			log.Printf("can't read binfmt_misc handler %s: %v", f.Name(), err)
+			continue
+		}
+		h, err := parseBinfmtHandler(f.Name(), data)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if !h.matches(header) {
+			continue
+		}
+		if !h.usableIn(chrootDir) {
+			log.Printf("not using binfmt_misc handler %s, %s is not in the chroot", h.name, h.interpreter)
+			continue
+		}
+		return h, nil
+	}
+	return nil, nil
+}
+
 func (s *stepRegisterBinFmt) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
 	// Read our value and assert that it is they type we want
+	config := state.Get("config").(*Config)
 	ui := state.Get("ui").(packer.Ui)
-	qemu := state.Get(s.QemuPathKey).(string)
+	qemu, ok := state.Get(s.QemuPathKey).(string)
+	if !ok {
+		// qemu is not needed.
+		return multistep.ActionContinue
+	}
+
+	// a handler of the host doesn't run the qemu_binary or qemu_args that were asked for.
+	if !config.qemuBinarySet && len(config.QemuArgs) == 0 {
+		chrootDir := state.Get(s.ChrootKey).(string)
+		handler, err := findBinfmtHandler(chrootDir, config.ImageArch)
+		if err != nil {
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+		if handler != nil {
+			ui.Say(fmt.Sprintf("Using the existing binfmt_misc handler %s (%s)", handler.name, handler.interpreter))
+			return multistep.ActionContinue
+		}
+	}
+
 	name := namePrefix + strconv.Itoa(int(rand.Uint32()))
 
 	ui.Say("Registering " + qemu + " with binfmt_misc as " + name)
 
-	registerstring_prefix := []byte{':'}
-
-	registerstring_prefix = append(registerstring_prefix, []byte(name)...)
-	registerstring_prefix = append(registerstring_prefix, ':', 'M', ':', ':')
-	if strings.Contains(qemu, "64") {
-		registerstring_prefix = append(registerstring_prefix, qemu_aarch64_magic...)
-	} else {
-		registerstring_prefix = append(registerstring_prefix, qemu_arm_magic...)
+	fixBinary, _ := state.Get(s.FixBinaryKey).(bool)
+	registerstring, err := binfmtRegistration(name, config.ImageArch, qemu, fixBinary)
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
 	}
-
-	registerstring_prefix = append(registerstring_prefix, ':')
-	registerstring_prefix = append(registerstring_prefix, []byte(mask)...)
-	registerstring_prefix = append(registerstring_prefix, ':')
-	registerstring := append(registerstring_prefix, ([]byte(qemu))...)
-	registerstring = append(registerstring, ':')
-	f, err := os.OpenFile("/proc/sys/fs/binfmt_misc/register", os.O_RDWR, 0)
+	f, err := os.OpenFile(filepath.Join(binfmtMisc, "register"), os.O_RDWR, 0)
 	if err != nil {
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 	defer f.Close()
-	_, err = f.Write(registerstring)
+	_, err = f.WriteString(registerstring)
 	if err != nil {
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
-	if _, err := os.Stat("/proc/sys/fs/binfmt_misc/" + name); os.IsNotExist(err) {
+	if _, err := os.Stat(filepath.Join(binfmtMisc, name)); os.IsNotExist(err) {
 		ui.Error("binfmt_misc registration failed")
 		return multistep.ActionHalt
 	}
-	state.Put(s.BinfmtName, name);
+	state.Put(s.BinfmtName, name)
 	return multistep.ActionContinue
 }
 
 func (s *stepRegisterBinFmt) Cleanup(state multistep.StateBag) {
 	ui := state.Get("ui").(packer.Ui)
-	name := state.Get(s.BinfmtName).(string)
+	name, ok := state.Get(s.BinfmtName).(string)
+	if !ok {
+		return
+	}
 
 	ui.Say("deregistering " + name + " with binfmt_misc")
-	f, err := os.OpenFile("/proc/sys/fs/binfmt_misc/" + name, os.O_RDWR, 0)
+	f, err := os.OpenFile(filepath.Join(binfmtMisc, name), os.O_RDWR, 0)
 	if err != nil {
 		ui.Error(err.Error())
 		return
@@ -0,0 +1,94 @@
+package builder
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/arch"
+)
+
+func TestBinfmtRegistration(t *testing.T) {
+	registration, err := binfmtRegistration("test", arch.Arm, "/qemu-arm-static", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `:test:M::\x7f\x45\x4c\x46\x01\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x28\x00:` +
+		`\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff:/qemu-arm-static:`
+	if registration != expected {
+		t.Errorf("unexpected registration:\n%s\nexpected:\n%s", registration, expected)
+	}
+
+	registration, err = binfmtRegistration("test", arch.Arm64BE, "/usr/bin/qemu-aarch64_be-static", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(registration, ":/usr/bin/qemu-aarch64_be-static:F") {
+		t.Errorf("expected the F flag: %s", registration)
+	}
+
+	if _, err := binfmtRegistration("test", arch.Unknown, "/qemu", false); err == nil {
+		t.Error("expected an error for an unknown architecture")
+	}
+}
+
+// The magic of each architecture must be the ELF header of its binaries.
+func TestBinfmtMagic(t *testing.T) {
+	for _, value := range arch.Values() {
+		imageArch := arch.KnownArchType(value)
+		b, ok := binfmts[imageArch]
+		if !ok {
+			t.Errorf("%s: no binfmt_misc magic", imageArch)
+			continue
+		}
+		magic, mask := binfmtBytes(b.magic), binfmtBytes(b.mask)
+		if len(magic) != len(mask) {
+			t.Errorf("%s: the magic and mask have different lengths", imageArch)
+			continue
+		}
+
+		detected, err := arch.FromELF(bytes.NewReader(magic))
+		if err != nil {
+			t.Errorf("%s: %v", imageArch, err)
+		} else if detected != imageArch {
+			t.Errorf("%s: the magic is the header of a %s binary", imageArch, detected)
+		}
+	}
+}
+
+func TestBinfmtHandler(t *testing.T) {
+	h, err := parseBinfmtHandler("qemu-aarch64", []byte(`enabled
+interpreter /usr/bin/qemu-aarch64-static
+flags: OCF
+offset 0
+magic 7f454c460201010000000000000000000200b700
+mask ffffffffffffff00fffffffffffffffffeffffff
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.interpreter != "/usr/bin/qemu-aarch64-static" || h.flags != "OCF" {
+		t.Errorf("unexpected handler: %+v", h)
+	}
+	if !h.matches(binfmtBytes(binfmts[arch.Arm64].magic)) {
+		t.Error("expected the handler to run arm64 binaries")
+	}
+	for _, other := range []arch.KnownArchType{arch.Arm, arch.Arm64BE, arch.Riscv64} {
+		if h.matches(binfmtBytes(binfmts[other].magic)) {
+			t.Errorf("expected the handler not to run %s binaries", other)
+		}
+	}
+	if !h.usableIn(t.TempDir()) {
+		t.Error("expected a handler with the F flag to be usable in any chroot")
+	}
+
+	h.flags = ""
+	if h.usableIn(t.TempDir()) {
+		t.Error("expected the interpreter to be missing from the chroot")
+	}
+
+	h.enabled = false
+	if h.matches(binfmtBytes(binfmts[arch.Arm64].magic)) {
+		t.Error("expected a disabled handler not to match")
+	}
+}
@@ -4,14 +4,19 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
 
 	packer_common_common "github.com/hashicorp/packer-plugin-sdk/common"
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 )
 
+// stepResizeFs grows the filesystem of the partition that stepResizeLastPart grew, whose number
+// is in PartitionNumberKey.
 type stepResizeFs struct {
-	PartitionsKey string
+	PartitionsKey      string
+	PartitionNumberKey string
 }
 
 func (s *stepResizeFs) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
@@ -27,27 +32,80 @@ func (s *stepResizeFs) Run(ctx context.Context, state multistep.StateBag) multis
 		return multistep.ActionHalt
 	}
 
-	p := partitions[len(partitions)-1]
-	err := s.e2fsck(ctx, wrappedCommand, p)
+	// the partitions added by extra_partitions come after the grown partition on the disk, so it
+	// can't be found again.
+	p, err := partitionDevice(partitions, state.Get(s.PartitionNumberKey).(int))
 	if err != nil {
-		err := fmt.Errorf("Error e2fsck command: %s", err)
-		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
-
-	err = s.resize(ctx, wrappedCommand, p)
-
+	fstype, err := fsType(ctx, state, p)
 	if err != nil {
-		err := fmt.Errorf("Error creating resize command: %s", err)
+		return multistep.ActionHalt
+	}
+	ui.Say(fmt.Sprintf("Growing %s filesystem on %s", fstype, p))
+
+	switch fstype {
+	case "ext2", "ext3", "ext4":
+		err = s.e2fsck(ctx, wrappedCommand, p)
+		if err != nil {
+			err := fmt.Errorf("Error e2fsck command: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
+		err = s.resize(ctx, wrappedCommand, p)
+		if err != nil {
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	case "btrfs":
+		err = s.resizeMounted(ctx, state, p, "btrfs filesystem resize max %s")
+	case "xfs":
+		err = s.resizeMounted(ctx, state, p, "xfs_growfs %s")
+	case "f2fs":
+		err = run(ctx, state, fmt.Sprintf("resize.f2fs %s", p))
+	case "":
+		err = fmt.Errorf("Can't detect the filesystem on %s", p)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	default:
+		err = fmt.Errorf("Growing a %q filesystem is not supported. Supported filesystems are: ext2/3/4, btrfs, xfs, f2fs", fstype)
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 
+	if err != nil {
+		// run already reported the error.
+		return multistep.ActionHalt
+	}
+
 	return multistep.ActionContinue
 }
 
+// resizeMounted grows filesystems that can only be grown while mounted.
+// growCommand is formatted with the temporary mount point.
+func (s *stepResizeFs) resizeMounted(ctx context.Context, state multistep.StateBag, dev, growCommand string) error {
+	mnt, err := ioutil.TempDir("", "armimg-resize-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(mnt)
+
+	if err := run(ctx, state, fmt.Sprintf("mount %s %s", dev, mnt)); err != nil {
+		return err
+	}
+	err = run(ctx, state, fmt.Sprintf(growCommand, mnt))
+	if umountErr := run(ctx, state, "umount "+mnt); err == nil {
+		err = umountErr
+	}
+	return err
+}
+
 func (s *stepResizeFs) e2fsck(ctx context.Context, wrappedCommand packer_common_common.CommandWrapper, dev string) error {
 	e2fsckCommand, err := wrappedCommand(fmt.Sprintf("e2fsck -y -f %s", dev))
 	if err != nil {
@@ -3,18 +3,23 @@ package builder
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 	"github.com/rekby/mbr"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/gpt"
 )
 
 // sector size is 512 bytes
 const SectorShift = 9
 
+// stepResizeLastPart grows the image, and the partition that ends last on the disk into the new
+// space. The number of the grown partition is stored in ResultKey, for stepResizeFs.
 type stepResizeLastPart struct {
-	FromKey string
+	FromKey   string
+	ResultKey string
 }
 
 func (s *stepResizeLastPart) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
@@ -34,6 +39,14 @@ func (s *stepResizeLastPart) Run(_ context.Context, state multistep.StateBag) mu
 		return multistep.ActionHalt
 	}
 
+	// it isn't always the last one in the partition table.
+	number, err := lastPartitionOnDisk(imagefile)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error finding the last partition %v", err))
+		return multistep.ActionHalt
+	}
+	state.Put(s.ResultKey, number)
+
 	currentSize := stat.Size()
 	if targetSize > 0 {
 		if targetSize < currentSize {
@@ -61,29 +74,22 @@ func (s *stepResizeLastPart) Run(_ context.Context, state multistep.StateBag) mu
 	}
 
 	// resize the last partition
-	mbrp, err := s.getMbr(imagefile)
-	if err != nil {
-		ui.Error(fmt.Sprintf("Error retreiving mbr %v", err))
-		return multistep.ActionHalt
-	}
-	partitions := mbrp.GetAllPartitions()
-
-	if len(partitions) == 0 {
-		ui.Error("no partitions!")
-		return multistep.ActionHalt
-	}
-
-	var part *mbr.MBRPartition
-	for _, potentialpart := range partitions {
-		if !potentialpart.IsEmpty() {
-			part = potentialpart
+	mbrp, err := getMbr(imagefile)
+	if mbrp != nil && mbrp.IsGPT() {
+		// the protective mbr may claim the whole (32 bit) disk, which fails the mbr checks.
+		// that's fine, as the real partition table is the GPT.
+		err = s.resizeGpt(imagefile, mbrp, targetSize)
+		if err != nil {
+			ui.Error(fmt.Sprintf("Error resizing GPT %v", err))
+			return multistep.ActionHalt
 		}
+		return multistep.ActionContinue
 	}
-
-	if part == nil {
-		ui.Error(fmt.Sprintf("no partition %v", *mbrp))
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error retreiving mbr %v", err))
 		return multistep.ActionHalt
 	}
+	part := mbrp.GetPartition(number)
 	extrasector := uint32(extraSize >> SectorShift)
 	part.SetLBALen(part.GetLBALen() + extrasector)
 
@@ -103,7 +109,69 @@ func (s *stepResizeLastPart) Run(_ context.Context, state multistep.StateBag) mu
 	return multistep.ActionContinue
 }
 
-func (s *stepResizeLastPart) getMbr(imagefile string) (*mbr.MBR, error) {
+// resizeGpt moves the backup GPT to the end of the (already grown) image, and extends the
+// last partition to the last usable sector.
+func (s *stepResizeLastPart) resizeGpt(imagefile string, protective *mbr.MBR, targetSize int64) error {
+	f, err := os.OpenFile(imagefile, os.O_RDWR|os.O_SYNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	table, err := gpt.Read(f)
+	if err != nil {
+		return err
+	}
+
+	totalSectors := uint64(targetSize >> SectorShift)
+	oldBackup := table.Header.AlternateLBA
+	if err := table.Resize(totalSectors); err != nil {
+		return err
+	}
+
+	part := table.LastPartition()
+	if part == nil {
+		return fmt.Errorf("no partitions")
+	}
+	part.EndingLBA = table.Header.LastUsableLBA
+
+	return writeResizedGpt(f, table, protective, oldBackup, totalSectors)
+}
+
+// writeResizedGpt writes a GPT that was resized to totalSectors, and updates the protective mbr.
+func writeResizedGpt(f *os.File, table *gpt.Table, protective *mbr.MBR, oldBackup, totalSectors uint64) error {
+	if err := table.Write(f); err != nil {
+		return err
+	}
+
+	// wipe the old backup header, so it is not mistaken for a valid one.
+	if oldBackup != table.Header.AlternateLBA && oldBackup > 1 && oldBackup < totalSectors {
+		if _, err := f.WriteAt(make([]byte, gpt.SectorSize), int64(oldBackup)<<SectorShift); err != nil {
+			return err
+		}
+	}
+
+	return writeProtectiveMbr(f, protective, totalSectors)
+}
+
+// writeProtectiveMbr updates the protective mbr of a GPT disk to cover the whole disk.
+func writeProtectiveMbr(f *os.File, protective *mbr.MBR, totalSectors uint64) error {
+	for _, p := range protective.GetAllPartitions() {
+		if p.GetType() == mbr.PART_GPT {
+			protectiveLen := totalSectors - uint64(p.GetLBAStart())
+			if protectiveLen > 0xFFFFFFFF {
+				protectiveLen = 0xFFFFFFFF
+			}
+			p.SetLBALen(uint32(protectiveLen))
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return protective.Write(f)
+}
+
+func getMbr(imagefile string) (*mbr.MBR, error) {
 
 	disk, err := os.Open(imagefile)
 	if err != nil {
@@ -0,0 +1,65 @@
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/gpt"
+)
+
+// The partition that ends last on the disk is grown, even if it comes first in the table, and
+// stepResizeFs resizes the filesystem of the same partition.
+func TestResizeLastPartOnDisk(t *testing.T) {
+	for _, table := range []PartitionTable{Dos, Gpt} {
+		imagefile := filepath.Join(t.TempDir(), "image")
+		if err := createImage(imagefile, table, []ImagePartition{{Size: 1 << 20}, {Size: 2 << 20}}); err != nil {
+			t.Fatal(err)
+		}
+		swapPartitions(t, imagefile, table)
+		before := partitionSectors(t, imagefile, table)
+
+		state := new(multistep.BasicStateBag)
+		state.Put("config", &Config{LastPartitionExtraSize: 4 << 20})
+		state.Put("ui", &packer.BasicUi{Writer: ioutil.Discard, ErrorWriter: ioutil.Discard})
+		state.Put("imagefile", imagefile)
+		step := &stepResizeLastPart{FromKey: "imagefile", ResultKey: "grown_partition"}
+		if action := step.Run(context.Background(), state); action != multistep.ActionContinue {
+			t.Fatalf("%s: %v", table, state.Get("error"))
+		}
+
+		after := partitionSectors(t, imagefile, table)
+		if after[0] < before[0]+(4<<20)/512 || after[1] != before[1] {
+			t.Errorf("%s: partitions went from %v to %v sectors, expected the first one to grow", table, before, after)
+		}
+		dev, err := partitionDevice([]string{"/dev/loop0p1", "/dev/loop0p2"}, state.Get("grown_partition").(int))
+		if err != nil || dev != "/dev/loop0p1" {
+			t.Errorf("%s: the filesystem of %s (%v) would be resized, expected /dev/loop0p1", table, dev, err)
+		}
+	}
+}
+
+func partitionSectors(t *testing.T, imagefile string, table PartitionTable) []uint64 {
+	if table == Dos {
+		m, err := getMbr(imagefile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []uint64{uint64(m.GetPartition(1).GetLBALen()), uint64(m.GetPartition(2).GetLBALen())}
+	}
+
+	f, err := os.Open(imagefile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gptTable, err := gpt.Read(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []uint64{gptTable.Partitions[0].Sectors(), gptTable.Partitions[1].Sectors()}
+}
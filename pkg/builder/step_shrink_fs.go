@@ -0,0 +1,109 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// stepShrinkFs shrinks the ext2/3/4 filesystem on the last partition on the disk to its minimal
+// size plus the configured headroom. The new size of the filesystem in bytes is stored in
+// ResultKey, or 0 if it was not shrunk.
+type stepShrinkFs struct {
+	FromKey       string
+	PartitionsKey string
+	ResultKey     string
+}
+
+func (s *stepShrinkFs) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	imagefile := state.Get(s.FromKey).(string)
+	partitions := state.Get(s.PartitionsKey).([]string)
+	ui := state.Get("ui").(packer.Ui)
+
+	// the partition that stepShrinkLastPart shrinks.
+	number, err := lastPartitionOnDisk(imagefile)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error finding the last partition: %v", err))
+		return multistep.ActionHalt
+	}
+	p, err := partitionDevice(partitions, number)
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	fs, err := fsType(ctx, state, p)
+	if err != nil {
+		return multistep.ActionHalt
+	}
+	if fs != "ext2" && fs != "ext3" && fs != "ext4" {
+		ui.Say(fmt.Sprintf("Not shrinking the %q filesystem on %s, only ext2/3/4 filesystems can be shrunk", fs, p))
+		state.Put(s.ResultKey, uint64(0))
+		return multistep.ActionContinue
+	}
+
+	ui.Say(fmt.Sprintf("Shrinking filesystem on %s", p))
+
+	if err := run(ctx, state, fmt.Sprintf("e2fsck -y -f %s", p)); err != nil {
+		return multistep.ActionHalt
+	}
+
+	out, err := runOutput(ctx, state, fmt.Sprintf("dumpe2fs -h %s", p))
+	if err != nil {
+		return multistep.ActionHalt
+	}
+	blockSize, err := e2fsField(out, "Block size")
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	blockCount, err := e2fsField(out, "Block count")
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	out, err = runOutput(ctx, state, fmt.Sprintf("resize2fs -P %s", p))
+	if err != nil {
+		return multistep.ActionHalt
+	}
+	minBlocks, err := e2fsField(out, "Estimated minimum size of the filesystem")
+	if err != nil {
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	newBlocks := minBlocks + (config.MinimizeHeadroom+blockSize-1)/blockSize
+	if newBlocks >= blockCount {
+		ui.Say("Filesystem is already at its minimal size")
+		state.Put(s.ResultKey, uint64(0))
+		return multistep.ActionContinue
+	}
+
+	ui.Message(fmt.Sprintf("Shrinking filesystem from %v M to %v M", blockCount*blockSize/1024/1024, newBlocks*blockSize/1024/1024))
+	if err := run(ctx, state, fmt.Sprintf("resize2fs -f %s %d", p, newBlocks)); err != nil {
+		return multistep.ActionHalt
+	}
+
+	state.Put(s.ResultKey, newBlocks*blockSize)
+	return multistep.ActionContinue
+}
+
+func (s *stepShrinkFs) Cleanup(state multistep.StateBag) {
+}
+
+// e2fsField finds a "name: value" line in the output of the e2fs tools.
+func e2fsField(out, name string) (uint64, error) {
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == name {
+			return strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("can't find %q in output: %s", name, out)
+}
@@ -0,0 +1,90 @@
+package builder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/gpt"
+)
+
+func TestE2fsField(t *testing.T) {
+	out := `dumpe2fs 1.46.5 (30-Dec-2021)
+Filesystem volume name:   rootfs
+Block count:              262144
+Block size:               4096
+Estimated minimum size of the filesystem: 1234
+`
+	for name, expected := range map[string]uint64{
+		"Block count": 262144,
+		"Block size":  4096,
+		"Estimated minimum size of the filesystem": 1234,
+	} {
+		value, err := e2fsField(out, name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if value != expected {
+			t.Errorf("%s: got %d, expected %d", name, value, expected)
+		}
+	}
+
+	if _, err := e2fsField(out, "Free blocks"); err == nil {
+		t.Error("expected an error for a missing field")
+	}
+	if _, err := e2fsField(out, "Filesystem volume name"); err == nil {
+		t.Error("expected an error for a field that isn't a number")
+	}
+}
+
+// The partition that ends last on the disk is shrunk, even if it comes first in the table.
+func TestLastPartitionOnDisk(t *testing.T) {
+	for _, table := range []PartitionTable{Dos, Gpt} {
+		imagefile := filepath.Join(t.TempDir(), "image")
+		partitions := []ImagePartition{{Size: 1 << 20}, {Size: 2 << 20}}
+		if err := createImage(imagefile, table, partitions); err != nil {
+			t.Fatal(err)
+		}
+		if number, err := lastPartitionOnDisk(imagefile); err != nil || number != 2 {
+			t.Errorf("%s: got partition %d (%v), expected 2", table, number, err)
+		}
+
+		swapPartitions(t, imagefile, table)
+		if number, err := lastPartitionOnDisk(imagefile); err != nil || number != 1 {
+			t.Errorf("%s: got partition %d (%v) after swapping, expected 1", table, number, err)
+		}
+	}
+}
+
+func swapPartitions(t *testing.T, imagefile string, table PartitionTable) {
+	f, err := os.OpenFile(imagefile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if table == Dos {
+		m, err := getMbr(imagefile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p1, p2 := m.GetPartition(1), m.GetPartition(2)
+		start1, len1 := p1.GetLBAStart(), p1.GetLBALen()
+		p1.SetLBAStart(p2.GetLBAStart())
+		p1.SetLBALen(p2.GetLBALen())
+		p2.SetLBAStart(start1)
+		p2.SetLBALen(len1)
+		if err := m.Write(f); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	gptTable, err := gpt.Read(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gptTable.Partitions[0], gptTable.Partitions[1] = gptTable.Partitions[1], gptTable.Partitions[0]
+	if err := gptTable.Write(f); err != nil {
+		t.Fatal(err)
+	}
+}
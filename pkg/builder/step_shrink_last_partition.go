@@ -0,0 +1,163 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/rekby/mbr"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/gpt"
+)
+
+// stepShrinkLastPart is the inverse of stepResizeLastPart: it shrinks the last partition
+// to fit the (already shrunk) filesystem, and truncates the image file after it.
+type stepShrinkLastPart struct {
+	FromKey   string
+	FsSizeKey string
+}
+
+func (s *stepShrinkLastPart) Run(_ context.Context, state multistep.StateBag) multistep.StepAction {
+	imagefile := state.Get(s.FromKey).(string)
+	fsSize := state.Get(s.FsSizeKey).(uint64)
+	ui := state.Get("ui").(packer.Ui)
+
+	if fsSize == 0 {
+		return multistep.ActionContinue
+	}
+	sectors := uint64((fsSize + (1 << SectorShift) - 1) >> SectorShift)
+
+	number, err := lastPartitionOnDisk(imagefile)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error finding the last partition %v", err))
+		return multistep.ActionHalt
+	}
+
+	mbrp, err := getMbr(imagefile)
+	if mbrp != nil && mbrp.IsGPT() {
+		err = s.shrinkGpt(imagefile, mbrp, number, sectors)
+		if err != nil {
+			ui.Error(fmt.Sprintf("Error shrinking GPT %v", err))
+			return multistep.ActionHalt
+		}
+		return multistep.ActionContinue
+	}
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error retreiving mbr %v", err))
+		return multistep.ActionHalt
+	}
+
+	part := mbrp.GetPartition(number)
+	if sectors > uint64(part.GetLBALen()) {
+		ui.Error(fmt.Sprintf("Filesystem (%v sectors) is bigger than its partition (%v sectors)", sectors, part.GetLBALen()))
+		return multistep.ActionHalt
+	}
+	part.SetLBALen(uint32(sectors))
+
+	f, err := os.OpenFile(imagefile, os.O_RDWR|os.O_SYNC, 0600)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Can't open image for writing %v", err))
+		return multistep.ActionHalt
+	}
+	defer f.Close()
+
+	err = mbrp.Write(f)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Can't write mbr  %v", err))
+		return multistep.ActionHalt
+	}
+
+	targetSize := int64(uint64(part.GetLBAStart())+sectors) << SectorShift
+	ui.Say(fmt.Sprintf("Shrinking image to %v M (%v bytes)", targetSize/1024/1024, targetSize))
+	err = f.Truncate(targetSize)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error shrinking image file %v", err))
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *stepShrinkLastPart) shrinkGpt(imagefile string, protective *mbr.MBR, number int, sectors uint64) error {
+	f, err := os.OpenFile(imagefile, os.O_RDWR|os.O_SYNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	table, err := gpt.Read(f)
+	if err != nil {
+		return err
+	}
+
+	part := &table.Partitions[number-1]
+	if sectors > part.Sectors() {
+		return fmt.Errorf("filesystem (%v sectors) is bigger than its partition (%v sectors)", sectors, part.Sectors())
+	}
+	part.EndingLBA = part.StartingLBA + sectors - 1
+
+	totalSectors := table.MinDiskSectors()
+	if err := table.Resize(totalSectors); err != nil {
+		return err
+	}
+	if err := table.Write(f); err != nil {
+		return err
+	}
+	if err := writeProtectiveMbr(f, protective, totalSectors); err != nil {
+		return err
+	}
+
+	return f.Truncate(int64(totalSectors) << SectorShift)
+}
+
+func (s *stepShrinkLastPart) Cleanup(state multistep.StateBag) {
+}
+
+// lastPartitionOnDisk returns the number of the partition that ends last on the disk, which is
+// the one that can be shrunk. It isn't always the last one in the partition table.
+func lastPartitionOnDisk(imagefile string) (int, error) {
+	number := 0
+	mbrp, err := getMbr(imagefile)
+	if mbrp != nil && mbrp.IsGPT() {
+		f, err := os.Open(imagefile)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		table, err := gpt.Read(f)
+		if err != nil {
+			return 0, err
+		}
+		var end uint64
+		for i, p := range table.Partitions {
+			if !p.IsEmpty() && (number == 0 || p.EndingLBA > end) {
+				number, end = i+1, p.EndingLBA
+			}
+		}
+	} else if err != nil {
+		return 0, err
+	} else {
+		var end uint32
+		for i, p := range mbrp.GetAllPartitions() {
+			if !p.IsEmpty() && (number == 0 || p.GetLBALast() > end) {
+				number, end = i+1, p.GetLBALast()
+			}
+		}
+	}
+	if number == 0 {
+		return 0, errors.New("no partitions")
+	}
+	return number, nil
+}
+
+// partitionDevice returns the mapped device of the partition with the given number.
+func partitionDevice(partitions []string, number int) (string, error) {
+	for _, dev := range partitions {
+		if partitionNumber(dev) == number {
+			return dev, nil
+		}
+	}
+	return "", fmt.Errorf("partition %d is not mapped: %v", number, partitions)
+}
@@ -0,0 +1,224 @@
+package builder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	getter "github.com/hashicorp/go-getter/v2"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image"
+)
+
+// stepStreamDownload downloads the source image and decodes it into the output image in a
+// single pass, instead of storing the download first. The checksum is computed over the
+// downloaded data, and the output image is removed if it doesn't match.
+type stepStreamDownload struct {
+	Checksum    string
+	Url         []string
+	ResultKey   string
+	ImageOpener image.ImageOpener
+}
+
+func (s *stepStreamDownload) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	config := state.Get("config").(*Config)
+	ui := state.Get("ui").(packer.Ui)
+
+	var errs []error
+	for _, src := range s.Url {
+		ui.Say(fmt.Sprintf("Streaming source image from %s", src))
+		err := s.stream(ctx, state, src, config.OutputFile)
+		if err == nil {
+			state.Put(s.ResultKey, config.OutputFile)
+			return multistep.ActionContinue
+		}
+		if _, ok := state.GetOk(multistep.StateCancelled); ok {
+			ui.Error("Download cancelled.")
+			return multistep.ActionHalt
+		}
+		ui.Error(fmt.Sprintf("Streaming %s failed: %v", src, err))
+		errs = append(errs, err)
+	}
+
+	err := fmt.Errorf("error streaming the source image: %v", errs)
+	state.Put("error", err)
+	ui.Error(err.Error())
+	return multistep.ActionHalt
+}
+
+func (s *stepStreamDownload) Cleanup(state multistep.StateBag) {
+}
+
+func (s *stepStreamDownload) stream(ctx context.Context, state multistep.StateBag, src, dstpath string) error {
+	checksum, err := sourceChecksum(ctx, s.Checksum, src)
+	if err != nil {
+		return err
+	}
+
+	body, size, err := openSource(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var r io.Reader = body
+	if checksum != nil {
+		checksum.Hash.Reset()
+		r = io.TeeReader(body, checksum.Hash)
+	}
+
+	img, err := s.ImageOpener.OpenReader(r, size)
+	if err != nil {
+		return err
+	}
+	err = writeImage(ctx, state, img, dstpath)
+	if cerr := img.Close(); err == nil && cerr != nil {
+		os.Remove(dstpath)
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if checksum == nil {
+		return nil
+	}
+	// the decoders may stop before the end of the data (e.g. padding after a tar archive), the
+	// checksum is over all of it.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		os.Remove(dstpath)
+		return err
+	}
+	if actual := checksum.Hash.Sum(nil); !bytes.Equal(actual, checksum.Value) {
+		os.Remove(dstpath)
+		return &getter.ChecksumError{Hash: checksum.Hash, Actual: actual, Expected: checksum.Value, File: src}
+	}
+	log.Printf("%s checksum of %s verified", checksum.Type, src)
+	return nil
+}
+
+// sourceChecksum resolves the iso_checksum of src the same way as StepDownload, including
+// checksum files. It returns nil if there is no checksum to verify.
+func sourceChecksum(ctx context.Context, checksum, src string) (*getter.FileChecksum, error) {
+	if checksum == "" || checksum == "none" {
+		return nil, nil
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("checksum", checksum)
+	u.RawQuery = q.Encode()
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	return getter.DefaultClient.GetChecksum(ctx, &getter.Request{Src: u.String(), Pwd: pwd})
+}
+
+// canStream returns true if src can be opened by openSource.
+func canStream(src string) bool {
+	u, err := url.Parse(src)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "", "file", "http", "https":
+		return true
+	}
+	return false
+}
+
+// randomAccessExtensions are the extensions of the formats that can't be decoded while they are
+// downloaded, for the urls that can't be read before the download.
+var randomAccessExtensions = map[string]bool{".zip": true, ".qcow2": true, ".vmdk": true, ".vhd": true, ".vhdx": true}
+
+// randomAccessFormat returns the format of src if it needs random access to be decoded, and so
+// can't be streamed. Local files are detected from their header, urls from their extension.
+func randomAccessFormat(src string) (string, bool) {
+	if path, ok := localPath(src); ok {
+		f, err := os.Open(path)
+		if err != nil {
+			// the download step reports it.
+			return "", false
+		}
+		defer f.Close()
+		header := make([]byte, 512)
+		n, _ := io.ReadFull(f, header)
+		return image.RandomAccessFormat(header[:n])
+	}
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", false
+	}
+	ext := strings.ToLower(filepath.Ext(u.Path))
+	return strings.TrimPrefix(ext, "."), randomAccessExtensions[ext]
+}
+
+// localPath returns the path of src, if it is a local file.
+func localPath(src string) (string, bool) {
+	u, err := url.Parse(src)
+	if err != nil {
+		return "", false
+	}
+	switch u.Scheme {
+	case "":
+		return src, true
+	case "file":
+		return u.Path, true
+	}
+	return "", false
+}
+
+// openSource opens a local file, or starts an http download. It also returns the size of the
+// data, 0 if unknown.
+func openSource(ctx context.Context, src string) (io.ReadCloser, uint64, error) {
+	if path, ok := localPath(src); ok {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, uint64(info.Size()), nil
+	}
+
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, 0, err
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, 0, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("bad response code: %d", resp.StatusCode)
+		}
+		var size uint64
+		if resp.ContentLength > 0 {
+			size = uint64(resp.ContentLength)
+		}
+		return resp.Body, size, nil
+	}
+	return nil, 0, errors.New("only local files and http(s) urls can be streamed")
+}
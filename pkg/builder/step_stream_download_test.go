@@ -0,0 +1,39 @@
+package builder
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRandomAccessFormat(t *testing.T) {
+	dir := t.TempDir()
+	zipFile := filepath.Join(dir, "image.img")
+	if err := ioutil.WriteFile(zipFile, []byte("PK\x03\x04rest of the zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	xzFile := filepath.Join(dir, "image.zip")
+	if err := ioutil.WriteFile(xzFile, []byte("\xfd7zXZ\x00rest of the xz"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		src, format string
+	}{
+		// local files are detected from their content, not their name.
+		{src: zipFile, format: "zip"},
+		{src: "file://" + zipFile, format: "zip"},
+		{src: xzFile},
+		{src: filepath.Join(dir, "missing.zip")},
+		{src: "https://example.com/image.zip", format: "zip"},
+		{src: "https://example.com/image.ZIP?download=1", format: "zip"},
+		{src: "https://example.com/disk.qcow2", format: "qcow2"},
+		{src: "https://example.com/disk.vhdx", format: "vhdx"},
+		{src: "https://example.com/image.img.xz"},
+	} {
+		format, ok := randomAccessFormat(tc.src)
+		if ok != (tc.format != "") || (ok && format != tc.format) {
+			t.Errorf("%s: got %q, %v, expected %q", tc.src, format, ok, tc.format)
+		}
+	}
+}
@@ -4,12 +4,19 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
 
 	packer_common_common "github.com/hashicorp/packer-plugin-sdk/common"
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/packer"
 )
 
+// shellQuote quotes s as a single argument of a shell command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 func run(ctx context.Context, state multistep.StateBag, cmds string) error {
 	wrappedCommand := state.Get("wrappedCommand").(packer_common_common.CommandWrapper)
 	ui := state.Get("ui").(packer.Ui)
@@ -35,3 +42,69 @@ func run(ctx context.Context, state multistep.StateBag, cmds string) error {
 	}
 	return nil
 }
+
+// like run, but returns the stdout of the command.
+func runOutput(ctx context.Context, state multistep.StateBag, cmds string) (string, error) {
+	wrappedCommand := state.Get("wrappedCommand").(packer_common_common.CommandWrapper)
+	ui := state.Get("ui").(packer.Ui)
+
+	shellcmd, err := wrappedCommand(cmds)
+	if err != nil {
+		err := fmt.Errorf("Error creating command '%s': %s", cmds, err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return "", err
+	}
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+
+	cmd := packer_common_common.ShellCommand(shellcmd)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		err := fmt.Errorf(
+			"Error executing command '%s': %s\nStderr: %s", cmds, err, stderr.String())
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// fsType detects the filesystem on a block device. Returns an empty string if it is unknown.
+// The blkid cache is not used, as loop devices are reused.
+func fsType(ctx context.Context, state multistep.StateBag, dev string) (string, error) {
+	// blkid exits with 2 if it can't detect the filesystem
+	out, err := runOutput(ctx, state, fmt.Sprintf("blkid -c /dev/null -o value -s TYPE %s || [ $? -eq 2 ]", dev))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+var blkidUnescape = strings.NewReplacer(`\\`, `\`, `\ `, ` `, `\'`, `'`, `\"`, `"`, `\$`, `$`, "\\`", "`")
+
+// probePartition returns the tags that blkid reports for a partition, e.g. LABEL, UUID, TYPE,
+// PARTLABEL and PARTUUID. The blkid cache is not used, as loop devices are reused.
+func probePartition(ctx context.Context, state multistep.StateBag, dev string) (map[string]string, error) {
+	// blkid exits with 2 if it can't detect anything
+	out, err := runOutput(ctx, state, fmt.Sprintf("blkid -c /dev/null -o export %s || [ $? -eq 2 ]", dev))
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			// values are escaped for the shell, e.g. "my\ label".
+			tags[k] = blkidUnescape.Replace(v)
+		}
+	}
+	return tags, nil
+}
+
+// partitionNumber returns the number of a partition device, e.g. 2 for /dev/loop0p2.
+func partitionNumber(dev string) int {
+	n, _ := strconv.Atoi(dev[strings.LastIndex(dev, "p")+1:])
+	return n
+}
@@ -0,0 +1,18 @@
+package builder
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	for _, s := range []string{"plain", "with space", "it's", `$(touch x) "; rm -rf /`, ""} {
+		out, err := exec.Command("sh", "-c", "printf %s "+shellQuote(s)).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != s {
+			t.Errorf("quoted %q as %s, the shell read %q", s, shellQuote(s), out)
+		}
+	}
+}
@@ -7,18 +7,32 @@ import (
 type KnownArchType string
 
 const (
-	Unknown KnownArchType = ""
-	Arm     KnownArchType = "arm"
-	ArmBE   KnownArchType = "armbe"
-	Arm64   KnownArchType = "arm64"
-	Arm64BE KnownArchType = "arm64be"
+	Unknown  KnownArchType = ""
+	Arm      KnownArchType = "arm"
+	ArmBE    KnownArchType = "armbe"
+	Arm64    KnownArchType = "arm64"
+	Arm64BE  KnownArchType = "arm64be"
+	Riscv64  KnownArchType = "riscv64"
+	I386     KnownArchType = "386"
+	Amd64    KnownArchType = "amd64"
+	Mips     KnownArchType = "mips"
+	MipsLE   KnownArchType = "mipsle"
+	Mips64   KnownArchType = "mips64"
+	Mips64LE KnownArchType = "mips64le"
 )
 
 var knownValues = map[KnownArchType]string{
-	Arm:     string(Arm),
-	ArmBE:   string(ArmBE),
-	Arm64:   string(Arm64),
-	Arm64BE: string(Arm64BE),
+	Arm:      string(Arm),
+	ArmBE:    string(ArmBE),
+	Arm64:    string(Arm64),
+	Arm64BE:  string(Arm64BE),
+	Riscv64:  string(Riscv64),
+	I386:     string(I386),
+	Amd64:    string(Amd64),
+	Mips:     string(Mips),
+	MipsLE:   string(MipsLE),
+	Mips64:   string(Mips64),
+	Mips64LE: string(Mips64LE),
 }
 
 func Values() []string {
@@ -34,6 +48,17 @@ func (arch KnownArchType) Valid() bool {
 	return ok
 }
 
+// the 32-bit architectures that 64-bit hosts can run the binaries of, if the kernel supports it.
+var compatArchs = map[string]KnownArchType{
+	"amd64": I386,
+	"arm64": Arm,
+}
+
+// IsNative returns whether the host runs binaries of the architecture without emulation.
 func (arch KnownArchType) IsNative() bool {
-	return string(arch) == runtime.GOARCH
+	if string(arch) == runtime.GOARCH {
+		return true
+	}
+	compat, ok := compatArchs[runtime.GOARCH]
+	return ok && compat == arch && compatSupported()
 }
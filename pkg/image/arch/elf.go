@@ -0,0 +1,56 @@
+package arch
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// elfHeader is what identifies the architecture of an ELF binary.
+type elfHeader struct {
+	class   elf.Class
+	data    elf.Data
+	machine elf.Machine
+}
+
+var elfHeaders = map[elfHeader]KnownArchType{
+	{elf.ELFCLASS32, elf.ELFDATA2LSB, elf.EM_ARM}:     Arm,
+	{elf.ELFCLASS32, elf.ELFDATA2MSB, elf.EM_ARM}:     ArmBE,
+	{elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_AARCH64}: Arm64,
+	{elf.ELFCLASS64, elf.ELFDATA2MSB, elf.EM_AARCH64}: Arm64BE,
+	{elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_RISCV}:   Riscv64,
+	{elf.ELFCLASS32, elf.ELFDATA2LSB, elf.EM_386}:     I386,
+	{elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_X86_64}:  Amd64,
+	{elf.ELFCLASS32, elf.ELFDATA2MSB, elf.EM_MIPS}:    Mips,
+	{elf.ELFCLASS32, elf.ELFDATA2LSB, elf.EM_MIPS}:    MipsLE,
+	{elf.ELFCLASS64, elf.ELFDATA2MSB, elf.EM_MIPS}:    Mips64,
+	{elf.ELFCLASS64, elf.ELFDATA2LSB, elf.EM_MIPS}:    Mips64LE,
+}
+
+// FromELF returns the architecture of an ELF binary, from its header.
+func FromELF(r io.Reader) (KnownArchType, error) {
+	// e_ident, e_type and e_machine.
+	var header [20]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Unknown, err
+	}
+	if string(header[:len(elf.ELFMAG)]) != elf.ELFMAG {
+		return Unknown, errors.New("not an ELF binary")
+	}
+
+	h := elfHeader{class: elf.Class(header[elf.EI_CLASS]), data: elf.Data(header[elf.EI_DATA])}
+	switch h.data {
+	case elf.ELFDATA2LSB:
+		h.machine = elf.Machine(binary.LittleEndian.Uint16(header[18:]))
+	case elf.ELFDATA2MSB:
+		h.machine = elf.Machine(binary.BigEndian.Uint16(header[18:]))
+	default:
+		return Unknown, fmt.Errorf("unknown ELF data encoding %v", h.data)
+	}
+	if arch, ok := elfHeaders[h]; ok {
+		return arch, nil
+	}
+	return Unknown, fmt.Errorf("unknown architecture: %v %v %v", h.class, h.data, h.machine)
+}
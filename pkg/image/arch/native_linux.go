@@ -0,0 +1,33 @@
+package arch
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	perLinux32       = 0x0008
+	queryPersonality = 0xffffffff
+)
+
+// compatSupported returns whether the kernel runs the binaries of the 32-bit architecture of the
+// host. x86_64 kernels do, arm64 kernels only on cpus that can run aarch32 code, which is what
+// switching to the PER_LINUX32 personality checks.
+func compatSupported() bool {
+	if runtime.GOARCH != "arm64" {
+		return true
+	}
+	// the personality is per thread.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	current, _, errno := unix.RawSyscall(unix.SYS_PERSONALITY, queryPersonality, 0, 0)
+	if errno != 0 {
+		return false
+	}
+	if _, _, errno := unix.RawSyscall(unix.SYS_PERSONALITY, perLinux32, 0, 0); errno != 0 {
+		return false
+	}
+	unix.RawSyscall(unix.SYS_PERSONALITY, current, 0, 0)
+	return true
+}
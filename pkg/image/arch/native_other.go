@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package arch
+
+// compatSupported is only checked on linux.
+func compatSupported() bool {
+	return false
+}
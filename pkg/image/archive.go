@@ -0,0 +1,125 @@
+package image
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// extensions of files in archives that are likely to be the image.
+var imageExtensions = []string{".img", ".raw", ".iso", ".bin"}
+
+// extensions of compressed files, an archive may contain e.g. an .img.xz.
+var compressedExtensions = []string{".xz", ".gz", ".bz2", ".zst", ".lz4"}
+
+// isImageMember returns true if the archive member with this name should be used as the image.
+func (c OpenerConfig) isImageMember(name string) bool {
+	if c.ArchiveMember != "" {
+		if match, _ := path.Match(c.ArchiveMember, name); match {
+			return true
+		}
+		match, _ := path.Match(c.ArchiveMember, path.Base(name))
+		return match
+	}
+
+	name = strings.ToLower(name)
+	for _, ext := range compressedExtensions {
+		name = strings.TrimSuffix(name, ext)
+	}
+	for _, ext := range imageExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c OpenerConfig) memberNotFound(names []string) error {
+	if c.ArchiveMember != "" {
+		return fmt.Errorf("no file matching %q in archive. archive contains: %v", c.ArchiveMember, names)
+	}
+	return fmt.Errorf("can't guess which file in the archive is the image, please specify it. archive contains: %v", names)
+}
+
+// selectZipMember picks the image out of the files in the zip.
+// If there is more than one candidate, the biggest one is the image.
+func (c OpenerConfig) selectZipMember(files []*zip.File) (*zip.File, error) {
+	var regular []*zip.File
+	var names []string
+	for _, f := range files {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		regular = append(regular, f)
+		names = append(names, f.Name)
+	}
+
+	if len(regular) == 1 && c.ArchiveMember == "" {
+		return regular[0], nil
+	}
+
+	var selected *zip.File
+	for _, f := range regular {
+		if !c.isImageMember(f.Name) {
+			continue
+		}
+		if selected == nil || f.UncompressedSize64 > selected.UncompressedSize64 {
+			selected = f
+		}
+	}
+	if selected == nil {
+		return nil, c.memberNotFound(names)
+	}
+	return selected, nil
+}
+
+// decodeZip needs random access to the zip file, so zip files can only be the outermost layer.
+func decodeZip(opts DecodeOptions, in *Stream) (*Stream, error) {
+	if in.File == nil {
+		return nil, errors.New("zip files inside other archives or compressed files, or streamed while downloading, are not supported")
+	}
+	r, err := zip.NewReader(in.File, fileSize(in.File))
+	if err != nil {
+		return nil, err
+	}
+
+	zippedfile, err := opts.selectZipMember(r.File)
+	if err != nil {
+		return nil, err
+	}
+	opts.Ui.Say("Unzipping " + zippedfile.Name)
+	zippedfileReader, err := zippedfile.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Stream{Reader: zippedfileReader, SizeEstimate: zippedfile.UncompressedSize64, Closers: []io.Closer{zippedfileReader}}, nil
+}
+
+// decodeTar streams the image out of the tar archive, without extracting it to the disk.
+// As tar archives can't be rewinded, the first file that looks like an image is used.
+func decodeTar(opts DecodeOptions, in *Stream) (*Stream, error) {
+	tr := tar.NewReader(in.Reader)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, opts.memberNotFound(names)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		names = append(names, hdr.Name)
+		if opts.isImageMember(hdr.Name) {
+			opts.Ui.Say("Extracting " + hdr.Name)
+			return &Stream{Reader: tr, SizeEstimate: uint64(hdr.Size)}, nil
+		}
+	}
+}
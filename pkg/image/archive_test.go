@@ -0,0 +1,97 @@
+package image
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+)
+
+type member struct {
+	name string
+	data []byte
+}
+
+var (
+	testImage   = bytes.Repeat([]byte("image"), 10000)
+	testMembers = []member{
+		{"README.md", []byte("readme")},
+		{"dir/board.img", testImage},
+		{"board.img.sha256", []byte("checksum")},
+	}
+)
+
+func makeZip(t *testing.T, members []member) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, m := range members {
+		f, err := w.Create(m.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(m.data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makeTarGz(t *testing.T, members []member) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	w := tar.NewWriter(gz)
+	for _, m := range members {
+		if err := w.WriteHeader(&tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.data))}); err != nil {
+			t.Fatal(err)
+		}
+		w.Write(m.data)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readImage(t *testing.T, opener ImageOpener, archive []byte) ([]byte, error) {
+	f := writeTemp(t, archive)
+	img, err := opener.Open(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	return ioutil.ReadAll(img)
+}
+
+func TestArchiveMembers(t *testing.T) {
+	for name, archive := range map[string][]byte{
+		"zip":    makeZip(t, testMembers),
+		"tar.gz": makeTarGz(t, testMembers),
+	} {
+		data, err := readImage(t, NewImageOpener(nil), archive)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(data, testImage) {
+			t.Errorf("%s: wrong member extracted by extension", name)
+		}
+
+		data, err = readImage(t, NewImageOpenerWithConfig(nil, OpenerConfig{ArchiveMember: "*.sha256"}), archive)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(data) != "checksum" {
+			t.Errorf("%s: wrong member extracted by pattern", name)
+		}
+
+		_, err = readImage(t, NewImageOpenerWithConfig(nil, OpenerConfig{ArchiveMember: "missing.img"}), archive)
+		if err == nil {
+			t.Errorf("%s: expected error for missing member", name)
+		}
+	}
+}
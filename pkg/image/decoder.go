@@ -0,0 +1,95 @@
+package image
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// how much of a stream is peeked to match it against the decoders.
+const headerSize = 512
+
+// Stream is the data of an image, in the process of being decoded.
+type Stream struct {
+	io.Reader
+	// File is set only if the stream is read as is from a file. Decoders that need random
+	// access (e.g. zip) require it.
+	File *os.File
+	// Estimated size of the data in the stream, 0 if unknown.
+	SizeEstimate uint64
+	// Closers are closed when the image is closed.
+	Closers []io.Closer
+	// Commands are waited for after the closers are closed.
+	Commands []*exec.Cmd
+}
+
+// header returns the first bytes of the stream, without consuming them.
+func (st *Stream) header() []byte {
+	header := make([]byte, headerSize)
+	if st.File != nil && st.Reader == io.Reader(st.File) {
+		n, _ := st.File.ReadAt(header, 0)
+		return header[:n]
+	}
+	br, ok := st.Reader.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(st.Reader, 1<<20)
+		st.Reader = br
+	}
+	// a short read is fine, the matchers check the length.
+	header, _ = br.Peek(headerSize)
+	return header
+}
+
+type DecodeOptions struct {
+	Ui packer.Ui
+	OpenerConfig
+}
+
+// Decoder decodes one layer of compression or archiving. Decoders are chained until the
+// stream doesn't match any decoder, which means it is a raw disk image.
+type Decoder struct {
+	// Name of the format, for messages.
+	Name string
+	// Decoders with a higher priority are matched first, decoders with the same priority in the
+	// order they are registered.
+	Priority int
+	// Match returns true if the stream is in this format. header holds the first bytes of the stream.
+	Match func(header []byte) bool
+	// RandomAccess is set for formats that can only be decoded from a file, e.g. zip.
+	RandomAccess bool
+	// Decode returns the decoded stream. The returned stream only needs to hold the closers
+	// and commands of this decoder, the ones of the input stream are kept as well.
+	Decode func(opts DecodeOptions, in *Stream) (*Stream, error)
+}
+
+var decoders []Decoder
+
+// RegisterDecoder adds a decoder to the registry. Image openers created after this call
+// will use it. This should be called from an init() function.
+func RegisterDecoder(d Decoder) {
+	decoders = append(decoders, d)
+	sort.SliceStable(decoders, func(i, j int) bool { return decoders[i].Priority > decoders[j].Priority })
+}
+
+func matchDecoder(registry []Decoder, header []byte) *Decoder {
+	for i := range registry {
+		if registry[i].Match(header) {
+			return &registry[i]
+		}
+	}
+	return nil
+}
+
+// RandomAccessFormat returns the name of the format of a file that starts with header, if it
+// can only be decoded from a file and not from a stream.
+func RandomAccessFormat(header []byte) (string, bool) {
+	d := matchDecoder(decoders, header)
+	if d == nil || !d.RandomAccess {
+		return "", false
+	}
+	return d.Name, true
+}
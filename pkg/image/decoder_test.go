@@ -0,0 +1,128 @@
+package image
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/vdisk"
+)
+
+func TestNestedDecoders(t *testing.T) {
+	imgXz := compress(t, testImage, newXzWriter)
+	imgZst := compress(t, testImage, func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) })
+
+	for name, archive := range map[string][]byte{
+		"zip > img.xz":     makeZip(t, []member{{"README.md", []byte("readme")}, {"board.img.xz", imgXz}}),
+		"tar.gz > img.zst": makeTarGz(t, []member{{"README.md", []byte("readme")}, {"board.img.zst", imgZst}}),
+		"xz > xz":          compress(t, imgXz, newXzWriter),
+	} {
+		data, err := readImage(t, NewImageOpener(nil), archive)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(data, testImage) {
+			t.Errorf("%s: wrong image data", name)
+		}
+	}
+}
+
+func TestNestedZipUnsupported(t *testing.T) {
+	zipped := makeZip(t, []member{{"board.img", testImage}})
+	_, err := readImage(t, NewImageOpener(nil), compress(t, zipped, newXzWriter))
+	if err == nil {
+		t.Error("expected error for a zip inside a xz file")
+	}
+}
+
+func TestVdiskSource(t *testing.T) {
+	for _, format := range vdisk.Formats {
+		f := writeTemp(t, nil)
+		if err := vdisk.Write(f, bytes.NewReader(testImage), int64(len(testImage)), format); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		img, err := NewImageOpener(nil).Open(f.Name())
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		data, err := ioutil.ReadAll(img)
+		img.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if !bytes.HasPrefix(data, testImage) || uint64(len(data)) != img.SizeEstimate() {
+			t.Errorf("%s: wrong image data", format)
+		}
+	}
+}
+
+func TestOpenReader(t *testing.T) {
+	archive := makeTarGz(t, []member{{"README.md", []byte("readme")}, {"board.img.xz", compress(t, testImage, newXzWriter)}})
+	img, err := NewImageOpener(nil).OpenReader(bytes.NewReader(archive), uint64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(img)
+	img.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, testImage) {
+		t.Error("wrong image data")
+	}
+
+	zipped := makeZip(t, []member{{"board.img", testImage}})
+	if _, err := NewImageOpener(nil).OpenReader(bytes.NewReader(zipped), uint64(len(zipped))); err == nil {
+		t.Error("expected error for a streamed zip")
+	}
+}
+
+func TestDecoderPriority(t *testing.T) {
+	registered := decoders
+	defer func() { decoders = registered }()
+	decoders = nil
+
+	match := func(header []byte) bool { return bytes.HasPrefix(header, []byte("magic")) }
+	RegisterDecoder(Decoder{Name: "low", Priority: 1, Match: match})
+	RegisterDecoder(Decoder{Name: "other", Priority: 5, Match: func([]byte) bool { return false }})
+	RegisterDecoder(Decoder{Name: "high", Priority: 10, Match: match})
+	RegisterDecoder(Decoder{Name: "high too", Priority: 10, Match: match})
+
+	// the first registered of the decoders with the highest priority wins.
+	if d := matchDecoder(decoders, []byte("magic header")); d == nil || d.Name != "high" {
+		t.Errorf("expected the high priority decoder to match, got %+v", d)
+	}
+	if d := matchDecoder(decoders, []byte("raw data")); d != nil {
+		t.Errorf("expected no decoder to match, got %s", d.Name)
+	}
+}
+
+func TestBuiltinDecoderPriorities(t *testing.T) {
+	priority := map[string]int{}
+	for _, d := range decoders {
+		if p, ok := priority[d.Name]; !ok || d.Priority < p {
+			priority[d.Name] = d.Priority
+		}
+	}
+	for _, tc := range []struct{ first, then string }{
+		{"qcow2", "gzip"},
+		{"vhd", "xz"},
+		{"Android sparse", "zstd"},
+		{"lz4", "zip"},
+		{"gzip", "tar"},
+	} {
+		if priority[tc.first] <= priority[tc.then] {
+			t.Errorf("expected %s to be matched before %s", tc.first, tc.then)
+		}
+	}
+
+	// both lz4 formats are decoded.
+	if d := matchDecoder(decoders, []byte{0x04, 0x22, 0x4D, 0x18, 0, 0, 0, 0}); d == nil || d.Name != "lz4" {
+		t.Errorf("expected the lz4 frame format to match")
+	}
+	if d := matchDecoder(decoders, []byte{0x02, 0x21, 0x4C, 0x18, 0, 0, 0, 0}); d == nil || d.Name != "lz4" {
+		t.Errorf("expected the legacy lz4 format to match")
+	}
+}
@@ -0,0 +1,212 @@
+package image
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/pierrec/lz4"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/simg"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/vdisk"
+	"github.com/ulikunitz/xz"
+	"gopkg.in/h2non/filetype.v1/matchers"
+)
+
+// priorities of the decoders whose headers may overlap.
+const (
+	// the headers of disk images are checked entirely, and are matched before the few magic bytes
+	// of compressed files. An image that matches nothing is raw.
+	priorityDiskImage = 20
+	// the lz4 frame format is matched before the legacy format.
+	priorityLz4       = 10
+	priorityLz4Legacy = 5
+	// tar files are only recognized by a magic at offset 257, which may be in other data.
+	priorityTar = -10
+)
+
+func init() {
+	RegisterDecoder(Decoder{Name: "zip", Match: matchers.Zip, RandomAccess: true, Decode: decodeZip})
+	RegisterDecoder(Decoder{Name: "tar", Priority: priorityTar, Match: matchers.Tar, Decode: decodeTar})
+	RegisterDecoder(Decoder{Name: "xz", Match: matchers.Xz, Decode: decodeXz})
+	RegisterDecoder(Decoder{Name: "gzip", Match: matchers.Gz, Decode: decodeGzip})
+	RegisterDecoder(Decoder{Name: "bzip2", Match: matchers.Bz2, Decode: decodeBzip})
+	RegisterDecoder(Decoder{Name: "zstd", Match: matchZstd, Decode: decodeZstd})
+	RegisterDecoder(Decoder{Name: "lz4", Priority: priorityLz4, Match: matchLz4, Decode: decodeLz4})
+	RegisterDecoder(Decoder{Name: "lz4", Priority: priorityLz4Legacy, Match: matchLz4Legacy, Decode: decodeLz4Legacy})
+	RegisterDecoder(Decoder{Name: "Android sparse", Priority: priorityDiskImage, Match: simg.IsSparse, Decode: decodeSimg})
+	for _, format := range vdisk.Formats {
+		format := format
+		RegisterDecoder(Decoder{
+			Name:         string(format),
+			Priority:     priorityDiskImage,
+			Match:        func(header []byte) bool { return vdisk.Detect(header) == format },
+			RandomAccess: true,
+			Decode:       decodeVdisk,
+		})
+	}
+}
+
+// magic numbers are little endian.
+func matchZstd(buf []byte) bool {
+	return len(buf) > 3 &&
+		buf[0] == 0x28 && buf[1] == 0xB5 &&
+		buf[2] == 0x2F && buf[3] == 0xFD
+}
+
+func matchLz4(buf []byte) bool {
+	return len(buf) > 3 &&
+		buf[0] == 0x04 && buf[1] == 0x22 &&
+		buf[2] == 0x4D && buf[3] == 0x18
+}
+
+func matchLz4Legacy(buf []byte) bool {
+	return len(buf) > 3 &&
+		buf[0] == 0x02 && buf[1] == 0x21 &&
+		buf[2] == 0x4C && buf[3] == 0x18
+}
+
+func decodeXz(opts DecodeOptions, in *Stream) (*Stream, error) {
+	var sizeEstimate uint64
+	var streams []xzStream
+	if in.File != nil {
+		sizeEstimate = xzSizeEstimate(in.File)
+		streams, _ = xzIndex(in.File, fileSize(in.File))
+	}
+	return uncompress(in, "xzcat", sizeEstimate, func(r io.Reader) (io.Reader, error) {
+		// files with huge blocks are decompressed sequentially.
+		workers := parallelXzWorkers(opts.workers(), xzMaxBlockSize(streams))
+		if workers > 1 && xzBlockCount(streams) > 1 {
+			opts.Ui.Message(fmt.Sprintf("Decompressing %d xz blocks with %d workers", xzBlockCount(streams), workers))
+			return newParallelXzReader(in.File, streams, workers), nil
+		}
+		r2, e := xz.NewReader(r)
+		return r2, e
+	})
+}
+
+func decodeGzip(opts DecodeOptions, in *Stream) (*Stream, error) {
+	var sizeEstimate uint64
+	if in.File != nil {
+		sizeEstimate = gzipSizeEstimate(in.File)
+	}
+	return uncompress(in, "zcat", sizeEstimate, func(r io.Reader) (io.Reader, error) {
+		if opts.workers() > 1 && in.File != nil && gzipMultiMember(in.File, fileSize(in.File)) {
+			opts.Ui.Message(fmt.Sprintf("Decompressing the gzip members with %d workers", opts.workers()))
+			// the members held at once, and the one being read, fit in maxParallelMemory.
+			memberLimit := int64(maxParallelMemory / (opts.workers() + 1))
+			return newParallelGzipReader(in.File, fileSize(in.File), opts.workers(), memberLimit), nil
+		}
+		// a single deflate stream can't be decompressed in parallel, pgzip only reads ahead and
+		// checksums in other goroutines.
+		if opts.workers() > 1 {
+			return pgzip.NewReaderN(r, 1<<20, opts.workers())
+		}
+		r2, e := gzip.NewReader(r)
+		return r2, e
+	})
+}
+
+func decodeBzip(opts DecodeOptions, in *Stream) (*Stream, error) {
+	return uncompress(in, "bzcat", 0, func(r io.Reader) (io.Reader, error) { r2 := bzip2.NewReader(r); return r2, nil })
+}
+
+func decodeZstd(opts DecodeOptions, in *Stream) (*Stream, error) {
+	var sizeEstimate uint64
+	if in.File != nil {
+		sizeEstimate = zstdSizeEstimate(in.File)
+	}
+	return uncompress(in, "zstdcat", sizeEstimate, func(r io.Reader) (io.Reader, error) {
+		// allow images compressed with --long=31
+		r2, e := zstd.NewReader(r, zstd.WithDecoderMaxWindow(1<<31))
+		if e != nil {
+			return nil, e
+		}
+		return r2.IOReadCloser(), nil
+	})
+}
+
+func decodeLz4(opts DecodeOptions, in *Stream) (*Stream, error) {
+	var sizeEstimate uint64
+	if in.File != nil {
+		sizeEstimate = lz4SizeEstimate(in.File)
+	}
+	return uncompress(in, "lz4cat", sizeEstimate, func(r io.Reader) (io.Reader, error) { return lz4.NewReader(r), nil })
+}
+
+func decodeLz4Legacy(opts DecodeOptions, in *Stream) (*Stream, error) {
+	return uncompress(in, "lz4cat", 0, func(r io.Reader) (io.Reader, error) { return lz4.NewReaderLegacy(r), nil })
+}
+
+// decodeSimg expands Android sparse images while they are read.
+func decodeSimg(opts DecodeOptions, in *Stream) (*Stream, error) {
+	r, err := simg.NewReader(in.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{Reader: r, SizeEstimate: uint64(r.Size())}, nil
+}
+
+// decodeVdisk reads the disk of a virtual machine image as a raw image. Like zip files,
+// virtual machine images need random access.
+func decodeVdisk(opts DecodeOptions, in *Stream) (*Stream, error) {
+	if in.File == nil {
+		return nil, errors.New("virtual machine images inside other archives or compressed files, or streamed while downloading, are not supported")
+	}
+	disk, err := vdisk.Open(in.File, fileSize(in.File))
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{Reader: io.NewSectionReader(disk, 0, disk.Size()), SizeEstimate: uint64(disk.Size())}, nil
+}
+
+// uncompress uses the native fastcmd if it is available, and falls back to the go implementation.
+func uncompress(in *Stream, fastcmd string, sizeEstimate uint64, slowNewReader func(r io.Reader) (io.Reader, error)) (*Stream, error) {
+	// check if available:
+	if exec.Command("which", fastcmd).Run() == nil {
+		ret, err := xzFastlane(fastcmd, in.Reader, sizeEstimate)
+		if err == nil {
+			return ret, err
+		}
+	}
+	// slow lane here. the go decompressors do a lot of small reads.
+	br, ok := in.Reader.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReaderSize(in.Reader, 1<<20)
+	}
+	r, err := slowNewReader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &Stream{Reader: r, SizeEstimate: sizeEstimate}
+	if c, ok := r.(io.Closer); ok {
+		// some decompressors hold resources (e.g. goroutines) that need to be released
+		out.Closers = append(out.Closers, c)
+	}
+	return out, nil
+}
+
+func xzFastlane(cmd string, in io.Reader, sizeEstimate uint64) (*Stream, error) {
+
+	xzcat := exec.Command(cmd)
+
+	// fast path, use xzcat
+	xzcat.Stdin = in
+	r, err := xzcat.StdoutPipe()
+
+	if err != nil {
+		return nil, err
+	}
+	if err := xzcat.Start(); err != nil {
+		return nil, err
+	}
+
+	return &Stream{Reader: r, SizeEstimate: sizeEstimate, Closers: []io.Closer{r}, Commands: []*exec.Cmd{xzcat}}, nil
+
+}
@@ -0,0 +1,324 @@
+package gpt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// sector size is 512 bytes
+const SectorSize = 512
+
+const (
+	headerSignature = "EFI PART"
+	headerRevision  = 0x00010000
+	headerSize      = 92
+)
+
+var ErrNotGPT = errors.New("GPT: bad header signature")
+
+// Header is the on disk GPT header. See UEFI spec, section 5.3.2.
+type Header struct {
+	Signature                [8]byte
+	Revision                 uint32
+	HeaderSize               uint32
+	HeaderCRC32              uint32
+	Reserved                 uint32
+	MyLBA                    uint64
+	AlternateLBA             uint64
+	FirstUsableLBA           uint64
+	LastUsableLBA            uint64
+	DiskGUID                 [16]byte
+	PartitionEntryLBA        uint64
+	NumberOfPartitionEntries uint32
+	SizeOfPartitionEntry     uint32
+	PartitionEntryArrayCRC32 uint32
+}
+
+// Partition is a single entry in the GPT partition entry array.
+type Partition struct {
+	TypeGUID      [16]byte
+	UniqueGUID    [16]byte
+	StartingLBA   uint64
+	EndingLBA     uint64
+	Attributes    uint64
+	PartitionName [72]byte
+}
+
+func (p *Partition) IsEmpty() bool {
+	return p.TypeGUID == [16]byte{}
+}
+
+// Sectors returns the number of sectors in the partition.
+func (p *Partition) Sectors() uint64 {
+	return p.EndingLBA - p.StartingLBA + 1
+}
+
+// Name returns the partition name, decoded from UTF-16LE.
+func (p *Partition) Name() string {
+	var runes []rune
+	for i := 0; i+1 < len(p.PartitionName); i += 2 {
+		c := binary.LittleEndian.Uint16(p.PartitionName[i:])
+		if c == 0 {
+			break
+		}
+		runes = append(runes, rune(c))
+	}
+	return string(runes)
+}
+
+// SetName sets the partition name, encoded as UTF-16LE. Names longer than 36 characters are
+// truncated.
+func (p *Partition) SetName(name string) {
+	p.PartitionName = [72]byte{}
+	i := 0
+	for _, r := range name {
+		if i+1 >= len(p.PartitionName) {
+			break
+		}
+		if r > 0xffff {
+			r = '?'
+		}
+		binary.LittleEndian.PutUint16(p.PartitionName[i:], uint16(r))
+		i += 2
+	}
+}
+
+// ParseGUID parses a GUID in its usual text form, e.g. C12A7328-F81F-11D2-BA4B-00A0C93EC93B.
+// The first three fields are stored little endian on disk.
+func ParseGUID(s string) ([16]byte, error) {
+	var guid [16]byte
+	fields := strings.Split(s, "-")
+	if len(fields) != 5 || len(s) != 36 {
+		return guid, fmt.Errorf("GPT: bad GUID %q", s)
+	}
+	raw, err := hex.DecodeString(strings.Join(fields, ""))
+	if err != nil {
+		return guid, fmt.Errorf("GPT: bad GUID %q", s)
+	}
+	binary.LittleEndian.PutUint32(guid[0:], binary.BigEndian.Uint32(raw[0:]))
+	binary.LittleEndian.PutUint16(guid[4:], binary.BigEndian.Uint16(raw[4:]))
+	binary.LittleEndian.PutUint16(guid[6:], binary.BigEndian.Uint16(raw[6:]))
+	copy(guid[8:], raw[8:])
+	return guid, nil
+}
+
+// NewGUID returns a random (version 4) GUID.
+func NewGUID() [16]byte {
+	var guid [16]byte
+	rand.Read(guid[:])
+	guid[7] = guid[7]&0x0f | 0x40
+	guid[8] = guid[8]&0x3f | 0x80
+	return guid
+}
+
+type Table struct {
+	Header     Header
+	Partitions []Partition
+	// entry size may be bigger than the struct, we keep the raw entries so
+	// that we don't lose any data when writing them back.
+	entrySize int
+	raw       []byte
+}
+
+// NewTableEntries is the number of partition entries of the tables made by New.
+const NewTableEntries = 128
+
+// New returns an empty table with NewTableEntries partition entries, for a disk of totalSectors
+// sectors.
+func New(totalSectors uint64) (*Table, error) {
+	const entries, entrySize = NewTableEntries, 128
+	t := &Table{
+		Header: Header{
+			Revision:                 headerRevision,
+			HeaderSize:               headerSize,
+			FirstUsableLBA:           2 + entries*entrySize/SectorSize,
+			DiskGUID:                 NewGUID(),
+			PartitionEntryLBA:        2,
+			NumberOfPartitionEntries: entries,
+			SizeOfPartitionEntry:     entrySize,
+		},
+		Partitions: make([]Partition, entries),
+		entrySize:  entrySize,
+		raw:        make([]byte, entries*entrySize),
+	}
+	copy(t.Header.Signature[:], headerSignature)
+	if err := t.Resize(totalSectors); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+/*
+Read the primary GPT from disk. LBA 0 is expected to be the protective MBR.
+*/
+func Read(disk io.ReaderAt) (*Table, error) {
+	hdrbytes := make([]byte, SectorSize)
+	if _, err := disk.ReadAt(hdrbytes, SectorSize); err != nil {
+		return nil, err
+	}
+
+	var t Table
+	if err := binary.Read(bytes.NewReader(hdrbytes), binary.LittleEndian, &t.Header); err != nil {
+		return nil, err
+	}
+	if string(t.Header.Signature[:]) != headerSignature {
+		return nil, ErrNotGPT
+	}
+	if t.Header.HeaderSize < headerSize || t.Header.HeaderSize > SectorSize {
+		return nil, fmt.Errorf("GPT: bad header size %d", t.Header.HeaderSize)
+	}
+	hdrcrc := t.Header.HeaderCRC32
+	for i := 16; i < 20; i++ {
+		hdrbytes[i] = 0
+	}
+	if crc32.ChecksumIEEE(hdrbytes[:t.Header.HeaderSize]) != hdrcrc {
+		return nil, errors.New("GPT: bad header CRC")
+	}
+
+	t.entrySize = int(t.Header.SizeOfPartitionEntry)
+	if t.entrySize < binary.Size(Partition{}) {
+		return nil, fmt.Errorf("GPT: bad partition entry size %d", t.entrySize)
+	}
+	t.raw = make([]byte, t.entrySize*int(t.Header.NumberOfPartitionEntries))
+	if _, err := disk.ReadAt(t.raw, int64(t.Header.PartitionEntryLBA*SectorSize)); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(t.raw) != t.Header.PartitionEntryArrayCRC32 {
+		return nil, errors.New("GPT: bad partition entry array CRC")
+	}
+
+	t.Partitions = make([]Partition, t.Header.NumberOfPartitionEntries)
+	for i := range t.Partitions {
+		entry := t.raw[i*t.entrySize : (i+1)*t.entrySize]
+		if err := binary.Read(bytes.NewReader(entry), binary.LittleEndian, &t.Partitions[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return &t, nil
+}
+
+// LastPartition returns the non empty partition that ends last on the disk.
+func (t *Table) LastPartition() *Partition {
+	var last *Partition
+	for i := range t.Partitions {
+		p := &t.Partitions[i]
+		if p.IsEmpty() {
+			continue
+		}
+		if last == nil || p.EndingLBA > last.EndingLBA {
+			last = p
+		}
+	}
+	return last
+}
+
+// entryArraySectors is the number of sectors the partition entry array occupies.
+func (t *Table) entryArraySectors() uint64 {
+	return (uint64(len(t.raw)) + SectorSize - 1) / SectorSize
+}
+
+// MinDiskSectors is the smallest disk size, in sectors, that fits all the partitions
+// and the backup GPT.
+func (t *Table) MinDiskSectors() uint64 {
+	lastUsed := t.Header.FirstUsableLBA - 1
+	if last := t.LastPartition(); last != nil {
+		lastUsed = last.EndingLBA
+	}
+	return lastUsed + 1 + t.entryArraySectors() + 1
+}
+
+/*
+Resize updates the table for a disk of totalSectors sectors: the backup header and
+partition entry array are moved to the end of the disk, and the last usable LBA is
+updated accordingly. Partitions are not modified.
+*/
+func (t *Table) Resize(totalSectors uint64) error {
+	arraySectors := t.entryArraySectors()
+	if totalSectors < t.Header.FirstUsableLBA+arraySectors+1 {
+		return fmt.Errorf("GPT: disk with %d sectors is too small", totalSectors)
+	}
+	lastUsable := totalSectors - 1 - arraySectors - 1
+	if last := t.LastPartition(); last != nil && last.EndingLBA > lastUsable {
+		return fmt.Errorf("GPT: partition ends at %d, after last usable sector %d", last.EndingLBA, lastUsable)
+	}
+	t.Header.MyLBA = 1
+	t.Header.AlternateLBA = totalSectors - 1
+	t.Header.LastUsableLBA = lastUsable
+	return nil
+}
+
+func (t *Table) marshalEntries() ([]byte, error) {
+	raw := make([]byte, len(t.raw))
+	copy(raw, t.raw)
+	for i := range t.Partitions {
+		var buf bytes.Buffer
+		if err := binary.Write(&buf, binary.LittleEndian, &t.Partitions[i]); err != nil {
+			return nil, err
+		}
+		copy(raw[i*t.entrySize:], buf.Bytes())
+	}
+	return raw, nil
+}
+
+func marshalHeader(h Header) ([]byte, error) {
+	h.HeaderCRC32 = 0
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	hdrbytes := make([]byte, SectorSize)
+	copy(hdrbytes, buf.Bytes())
+	binary.LittleEndian.PutUint32(hdrbytes[16:], crc32.ChecksumIEEE(hdrbytes[:h.HeaderSize]))
+	return hdrbytes, nil
+}
+
+/*
+Write both the primary and the backup GPT to disk. Both CRCs are recomputed.
+The backup is placed at Header.AlternateLBA, with its partition entry array right
+before it.
+*/
+func (t *Table) Write(disk io.WriterAt) error {
+	entries, err := t.marshalEntries()
+	if err != nil {
+		return err
+	}
+	t.raw = entries
+
+	primary := t.Header
+	primary.Signature = [8]byte{'E', 'F', 'I', ' ', 'P', 'A', 'R', 'T'}
+	primary.PartitionEntryArrayCRC32 = crc32.ChecksumIEEE(entries)
+	if primary.Revision == 0 {
+		primary.Revision = headerRevision
+	}
+	if primary.HeaderSize == 0 {
+		primary.HeaderSize = headerSize
+	}
+
+	backup := primary
+	backup.MyLBA, backup.AlternateLBA = primary.AlternateLBA, primary.MyLBA
+	backup.PartitionEntryLBA = primary.AlternateLBA - t.entryArraySectors()
+
+	for _, h := range []Header{primary, backup} {
+		if _, err := disk.WriteAt(entries, int64(h.PartitionEntryLBA*SectorSize)); err != nil {
+			return err
+		}
+		hdrbytes, err := marshalHeader(h)
+		if err != nil {
+			return err
+		}
+		if _, err := disk.WriteAt(hdrbytes, int64(h.MyLBA*SectorSize)); err != nil {
+			return err
+		}
+	}
+
+	t.Header = primary
+	return nil
+}
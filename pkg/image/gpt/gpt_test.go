@@ -0,0 +1,147 @@
+package gpt
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const entries = 128
+
+func newTestDisk(t *testing.T, sectors int64) *os.File {
+	f, err := ioutil.TempFile("", "gpt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+		os.Remove(f.Name())
+	})
+	if err := f.Truncate(sectors * SectorSize); err != nil {
+		t.Fatal(err)
+	}
+
+	table := &Table{
+		Header: Header{
+			MyLBA:                    1,
+			FirstUsableLBA:           34,
+			PartitionEntryLBA:        2,
+			NumberOfPartitionEntries: entries,
+			SizeOfPartitionEntry:     128,
+		},
+		Partitions: make([]Partition, entries),
+		entrySize:  128,
+		raw:        make([]byte, entries*128),
+	}
+	if err := table.Resize(uint64(sectors)); err != nil {
+		t.Fatal(err)
+	}
+	table.Partitions[0] = Partition{TypeGUID: [16]byte{1}, StartingLBA: 2048, EndingLBA: 4095}
+	table.Partitions[1] = Partition{TypeGUID: [16]byte{2}, StartingLBA: 4096, EndingLBA: 8191}
+	copy(table.Partitions[1].PartitionName[:], []byte{'r', 0, 'o', 0, 'o', 0, 't', 0})
+	if err := table.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestReadWrite(t *testing.T) {
+	f := newTestDisk(t, 10000)
+
+	table, err := Read(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Header.AlternateLBA != 9999 {
+		t.Errorf("unexpected backup lba %d", table.Header.AlternateLBA)
+	}
+	if table.Header.LastUsableLBA != 9999-32-1 {
+		t.Errorf("unexpected last usable lba %d", table.Header.LastUsableLBA)
+	}
+	last := table.LastPartition()
+	if last == nil || last.StartingLBA != 4096 {
+		t.Fatalf("unexpected last partition %v", last)
+	}
+	if last.Name() != "root" {
+		t.Errorf("unexpected name %q", last.Name())
+	}
+}
+
+func TestResize(t *testing.T) {
+	f := newTestDisk(t, 10000)
+	if err := f.Truncate(20000 * SectorSize); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := Read(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Resize(20000); err != nil {
+		t.Fatal(err)
+	}
+	table.LastPartition().EndingLBA = table.Header.LastUsableLBA
+	if err := table.Write(f); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err = Read(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.LastPartition().EndingLBA != 20000-32-2 {
+		t.Errorf("unexpected ending lba %d", table.LastPartition().EndingLBA)
+	}
+
+	// read the backup header, by pretending it's the primary one.
+	backup := make([]byte, SectorSize)
+	if _, err := f.ReadAt(backup, 19999*SectorSize); err != nil {
+		t.Fatal(err)
+	}
+	if string(backup[:8]) != headerSignature {
+		t.Fatalf("backup header not found at end of disk")
+	}
+
+	if err := table.Resize(5000); err == nil {
+		t.Errorf("expected error when partitions don't fit")
+	}
+}
+
+func TestNew(t *testing.T) {
+	f, err := ioutil.TempFile(t.TempDir(), "gpt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(10000 * SectorSize); err != nil {
+		t.Fatal(err)
+	}
+	table, err := New(10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	esp, err := ParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the GUID is mixed endian on disk.
+	if esp[0] != 0x28 || esp[3] != 0xc1 || esp[4] != 0x1f || esp[8] != 0xba || esp[15] != 0x3b {
+		t.Errorf("unexpected GUID bytes %x", esp)
+	}
+	table.Partitions[0] = Partition{TypeGUID: esp, UniqueGUID: NewGUID(), StartingLBA: 2048, EndingLBA: 4095}
+	table.Partitions[0].SetName("boot")
+	if err := table.Write(f); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := Read(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Header.FirstUsableLBA != 34 || read.Header.LastUsableLBA != 9999-32-1 {
+		t.Errorf("unexpected usable lbas %d-%d", read.Header.FirstUsableLBA, read.Header.LastUsableLBA)
+	}
+	if read.Partitions[0].TypeGUID != esp || read.Partitions[0].Name() != "boot" {
+		t.Errorf("unexpected partition %+v", read.Partitions[0])
+	}
+}
@@ -1,26 +1,41 @@
 package image
 
 import (
-	"archive/zip"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"runtime"
 
 	"github.com/hashicorp/packer-plugin-sdk/packer"
-	filetype "gopkg.in/h2non/filetype.v1"
-	"gopkg.in/h2non/filetype.v1/matchers"
-
-	"compress/bzip2"
-	"compress/gzip"
-
-	"github.com/ulikunitz/xz"
 )
 
+// maximum number of nested formats, e.g. a zip containing a .tar.xz with an .img.gz inside is 4.
+const maxDecodeDepth = 8
+
 type nilUi struct{}
 
 type imageOpener struct {
-	ui packer.Ui
+	ui       packer.Ui
+	config   OpenerConfig
+	decoders []Decoder
+}
+
+type OpenerConfig struct {
+	// Name or glob pattern of the image inside archives (zip, tar) that contain more than one file.
+	// If empty, the image is picked by its file extension.
+	ArchiveMember string
+	// Number of parallel workers used by the go decompressors, when the native tools are not
+	// available. Defaults to the number of CPUs.
+	Workers int
+}
+
+func (c OpenerConfig) workers() int {
+	if c.Workers > 0 {
+		return c.Workers
+	}
+	return runtime.NumCPU()
 }
 
 func (*nilUi) Ask(string) (string, error) {
@@ -44,166 +59,79 @@ func (*nilUi) TrackProgress(src string, currentSize, totalSize int64, stream io.
 }
 
 func NewImageOpener(ui packer.Ui) ImageOpener {
+	return NewImageOpenerWithConfig(ui, OpenerConfig{})
+}
+
+func NewImageOpenerWithConfig(ui packer.Ui, config OpenerConfig) ImageOpener {
 	if ui == nil {
 		ui = &nilUi{}
 	}
-	return &imageOpener{ui: ui}
+	registry := make([]Decoder, len(decoders))
+	copy(registry, decoders)
+	return &imageOpener{ui: ui, config: config, decoders: registry}
 }
 
 type fileImage struct {
 	io.ReadCloser
+	file *os.File
 	size uint64
 }
 
 func (f *fileImage) SizeEstimate() uint64 { return f.size }
-func openImage(file *os.File) (Image, error) {
-
-	finfo, err := file.Stat()
-	if err != nil {
-		return nil, err
-	}
-	fsize := finfo.Size()
-
-	ret := fileImage{ReadCloser: file, size: uint64(fsize)}
-	return &ret, nil
-
-}
+func (f *fileImage) RawFile() *os.File    { return f.file }
 
 func (s *imageOpener) Open(fpath string) (Image, error) {
-	t, _ := filetype.MatchFile(fpath)
-
 	f, err := os.Open(fpath)
 	if err != nil {
 		return nil, err
 	}
 
-	switch t {
-	case matchers.TypeZip:
-		s.ui.Say("Image is a zip file.")
-		return s.openzip(f)
-	case matchers.TypeXz:
-		s.ui.Say("Image is a xz file.")
-		return s.openxz(f)
-	case matchers.TypeGz:
-		s.ui.Say("Image is a gzip file.")
-		return s.opengzip(f)
-	case matchers.TypeBz2:
-		s.ui.Say("Image is a gzip file.")
-		return s.openbzip(f)
-	default:
-		return openImage(f)
-	}
-
-}
-
-func (s *imageOpener) openzip(f *os.File) (Image, error) {
-	defer func() {
-		if f != nil {
-			f.Close()
-		}
-	}()
-
-	fstat, err := f.Stat()
-	if err != nil {
-		return nil, err
-	}
-
-	r, err := zip.NewReader(f, fstat.Size())
-	if err != nil {
-		return nil, err
-	}
-
-	if len(r.File) != 1 {
-		return nil, errors.New("support for only zip files with one file.")
-	}
-
-	zippedfile := r.File[0]
-	s.ui.Say("Unzipping " + zippedfile.Name)
-	zippedfileReader, err := zippedfile.Open()
-	if err != nil {
-		return nil, err
-	}
-
-	//transfer ownership
-	mc := &multiCloser{zippedfileReader, []io.Closer{zippedfileReader, f}, nil, zippedfile.UncompressedSize64}
-	f = nil
-
-	return mc, nil
-}
-
-func (s *imageOpener) openxz(f *os.File) (Image, error) {
-	return uncompress(f, "xzcat", func(r io.Reader) (io.Reader, error) { r2, e := xz.NewReader(r); return r2, e })
+	return s.decode(&Stream{Reader: f, File: f, SizeEstimate: uint64(fileSize(f)), Closers: []io.Closer{f}})
 }
 
-func (s *imageOpener) opengzip(f *os.File) (Image, error) {
-
-	return uncompress(f, "zcat", func(r io.Reader) (io.Reader, error) { r2, e := gzip.NewReader(r); return r2, e })
+func (s *imageOpener) OpenReader(r io.Reader, size uint64) (Image, error) {
+	return s.decode(&Stream{Reader: r, SizeEstimate: size})
 }
 
-func (s *imageOpener) openbzip(f *os.File) (Image, error) {
-
-	return uncompress(f, "bzcat", func(r io.Reader) (io.Reader, error) { r2 := bzip2.NewReader(r); return r2, nil })
-}
-
-func uncompress(f *os.File, fastcmd string, slowNewReader func(r io.Reader) (io.Reader, error)) (Image, error) {
-	defer func() {
-		if f != nil {
-			f.Close()
+func (s *imageOpener) decode(stream *Stream) (Image, error) {
+	opts := DecodeOptions{Ui: s.ui, OpenerConfig: s.config}
+	for depth := 0; ; depth++ {
+		d := matchDecoder(s.decoders, stream.header())
+		if d == nil {
+			break
 		}
-	}()
-
-	// check if available:
-	if exec.Command("which", fastcmd).Run() == nil {
-		ret, err := xzFastlane(fastcmd, f)
-		if err == nil {
-			f = nil
-			return ret, err
+		if depth == maxDecodeDepth {
+			newMultiCloser(stream).Close()
+			return nil, fmt.Errorf("image is nested in more than %d archives or compressed files", maxDecodeDepth)
 		}
-	}
-	// slow lane here
-	r, err := slowNewReader(f)
-	if err != nil {
-		return nil, err
-	}
-
-	//transfer ownership
-	mc := &multiCloser{r, []io.Closer{f}, nil, 0}
-	f = nil
 
-	return mc, nil
-}
-
-func xzFastlane(cmd string, f *os.File) (Image, error) {
-
-	xzcat := exec.Command(cmd)
-
-	// fast path, use xzcat
-	xzcat.Stdin = f
-	r, err := xzcat.StdoutPipe()
-
-	if err != nil {
-		return nil, err
-	}
-	if err := xzcat.Start(); err != nil {
-		return nil, err
+		s.ui.Say(fmt.Sprintf("Image is a %s file.", d.Name))
+		decoded, err := d.Decode(opts, stream)
+		if err != nil {
+			newMultiCloser(stream).Close()
+			return nil, err
+		}
+		// inner layers are closed first.
+		decoded.Closers = append(decoded.Closers, stream.Closers...)
+		decoded.Commands = append(decoded.Commands, stream.Commands...)
+		stream = decoded
 	}
 
-	// use mc for size estimate
-	mc := &multiCloser{r, []io.Closer{r}, xzcat, 0}
-
-	return mc, nil
-
+	if stream.File != nil && stream.Reader == io.Reader(stream.File) {
+		return &fileImage{ReadCloser: stream.File, file: stream.File, size: stream.SizeEstimate}, nil
+	}
+	return newMultiCloser(stream), nil
 }
 
 type multiCloser struct {
 	io.Reader
 	c []io.Closer
 	// As the reader that is stored in c is the StdoutPipe of an exec.Cmd
-	// instance, we must ensure the command isn't closed prior to the reader
+	// instance, we must ensure the commands aren't closed prior to the reader
 	// being closed otherwise we end up with and error like:
 	// 'read |0: file already closed'.
 	// See also https://pkg.go.dev/os/exec#Cmd.StdoutPipe
-	command *exec.Cmd
+	commands []*exec.Cmd
 
 	sizeEstimate uint64
 }
@@ -216,10 +144,16 @@ func (n *multiCloser) Close() error {
 	var err error
 	// Wait for the readers (including StdoutPipe) to be closed
 	// and then initiate the command shutdown if we have a command.
-	if n.command != nil {
-		err = n.command.Wait()
+	for _, cmd := range n.commands {
+		if e := cmd.Wait(); e != nil && err == nil {
+			err = e
+		}
 	}
 	return err
 }
 
+func newMultiCloser(st *Stream) *multiCloser {
+	return &multiCloser{st.Reader, st.Closers, st.Commands, st.SizeEstimate}
+}
+
 func (f *multiCloser) SizeEstimate() uint64 { return f.sizeEstimate }
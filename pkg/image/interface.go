@@ -2,10 +2,15 @@ package image
 
 import (
 	"io"
+	"os"
 )
 
 type ImageOpener interface {
 	Open(filename string) (Image, error)
+	// OpenReader decodes an image that is read sequentially, e.g. while it is downloaded.
+	// size is the size of the data in r, 0 if unknown. Formats that need random access
+	// (zip, virtual machine images) can't be read this way.
+	OpenReader(r io.Reader, size uint64) (Image, error)
 }
 
 type ImageFile interface {
@@ -17,3 +22,9 @@ type Image interface {
 	io.ReadCloser
 	SizeEstimate() uint64
 }
+
+// RawImage is an image that is read as is from a file, with no decompression.
+type RawImage interface {
+	Image
+	RawFile() *os.File
+}
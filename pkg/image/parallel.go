@@ -0,0 +1,369 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/ulikunitz/xz"
+)
+
+// parallelXzReader decompresses the blocks of multi-block xz files (as written by xz -T) in
+// parallel. The blocks are located using the index of the file, so this needs random access.
+type parallelXzReader struct {
+	results chan chan xzBlockResult
+	done    chan struct{}
+	once    sync.Once
+
+	buf []byte
+	err error
+}
+
+type xzBlockResult struct {
+	data []byte
+	err  error
+}
+
+// blocks and members are decompressed in memory, this caps the memory of the ones held at once.
+const maxParallelMemory = 1 << 30
+
+// parallelXzWorkers returns how many blocks of up to blockSize bytes can be decompressed at once
+// within maxParallelMemory. Besides the blocks being decompressed, the reader holds one block.
+func parallelXzWorkers(workers int, blockSize uint64) int {
+	if blockSize == 0 {
+		return workers
+	}
+	blocks := maxParallelMemory / blockSize
+	if blocks == 0 {
+		return 0
+	}
+	if blocks-1 < uint64(workers) {
+		return int(blocks - 1)
+	}
+	return workers
+}
+
+func xzMaxBlockSize(streams []xzStream) uint64 {
+	var max uint64
+	for _, stream := range streams {
+		for _, block := range stream.blocks {
+			if block.uncompressed > max {
+				max = block.uncompressed
+			}
+		}
+	}
+	return max
+}
+
+func xzBlockCount(streams []xzStream) int {
+	count := 0
+	for _, stream := range streams {
+		count += len(stream.blocks)
+	}
+	return count
+}
+
+func newParallelXzReader(r io.ReaderAt, streams []xzStream, workers int) *parallelXzReader {
+	p := &parallelXzReader{
+		// at most workers blocks are decompressed ahead of the reader.
+		results: make(chan chan xzBlockResult, workers-1),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(p.results)
+		for _, stream := range streams {
+			offset := stream.offset + xzHeaderFooterSize
+			for _, block := range stream.blocks {
+				result := make(chan xzBlockResult, 1)
+				select {
+				case p.results <- result:
+				case <-p.done:
+					return
+				}
+				go func(stream xzStream, offset int64, block xzBlock) {
+					data, err := decompressXzBlock(r, stream, offset, block)
+					result <- xzBlockResult{data: data, err: err}
+				}(stream, offset, block)
+				offset += int64((block.unpadded + 3) &^ 3)
+			}
+		}
+	}()
+	return p
+}
+
+func (p *parallelXzReader) Read(b []byte) (int, error) {
+	for len(p.buf) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		result, ok := <-p.results
+		if !ok {
+			p.err = io.EOF
+			continue
+		}
+		r := <-result
+		p.buf, p.err = r.data, r.err
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+func (p *parallelXzReader) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
+
+// decompressXzBlock decompresses a single block, by wrapping it in a stream of its own.
+func decompressXzBlock(r io.ReaderAt, stream xzStream, offset int64, block xzBlock) ([]byte, error) {
+	paddedSize := int64((block.unpadded + 3) &^ 3)
+
+	var index bytes.Buffer
+	index.WriteByte(0)
+	var varint [binary.MaxVarintLen64]byte
+	for _, v := range []uint64{1, block.unpadded, block.uncompressed} {
+		index.Write(varint[:binary.PutUvarint(varint[:], v)])
+	}
+	for index.Len()%4 != 0 {
+		index.WriteByte(0)
+	}
+	binary.Write(&index, binary.LittleEndian, crc32.ChecksumIEEE(index.Bytes()))
+
+	// the footer holds the flags of the header, and the size of the index.
+	flags := stream.header[len(xzHeaderMagic) : len(xzHeaderMagic)+2]
+	footer := make([]byte, xzHeaderFooterSize)
+	binary.LittleEndian.PutUint32(footer[4:], uint32(index.Len()/4-1))
+	copy(footer[8:], flags)
+	copy(footer[10:], xzFooterMagic)
+	binary.LittleEndian.PutUint32(footer[0:], crc32.ChecksumIEEE(footer[4:10]))
+
+	single := make([]byte, xzHeaderFooterSize+paddedSize, xzHeaderFooterSize+paddedSize+int64(index.Len())+xzHeaderFooterSize)
+	copy(single, stream.header[:])
+	if _, err := r.ReadAt(single[xzHeaderFooterSize:], offset); err != nil {
+		return nil, err
+	}
+	single = append(append(single, index.Bytes()...), footer...)
+
+	xr, err := xz.NewReader(bytes.NewReader(single))
+	if err != nil {
+		return nil, err
+	}
+	data := bytes.NewBuffer(make([]byte, 0, block.uncompressed))
+	if _, err := io.Copy(data, xr); err != nil {
+		return nil, fmt.Errorf("xz: can't decompress block at offset %d: %v", offset, err)
+	}
+	if uint64(data.Len()) != block.uncompressed {
+		return nil, errors.New("xz: block size doesn't match the index")
+	}
+	return data.Bytes(), nil
+}
+
+// parallelGzipReader decompresses the members of multi-member gzip files (e.g. bgzip output, or
+// concatenated gzip files) in parallel. gzip has no index, so the file is scanned for member
+// headers. A header that is really part of the compressed data only costs a failed
+// decompression: members are only used where the previous one ends.
+type parallelGzipReader struct {
+	r       io.ReaderAt
+	size    int64
+	results chan chan gzipMemberResult
+	done    chan struct{}
+	once    sync.Once
+
+	// pos is where the next member starts.
+	pos int64
+	buf []byte
+	// member is a member too big to be decompressed in memory, which is decompressed as it is read.
+	member *gzipMember
+	err    error
+}
+
+type gzipMemberResult struct {
+	start, end int64
+	data       []byte
+	tooBig     bool
+	err        error
+}
+
+// how much of a gzip file is scanned for a second member, to tell if it has more than one.
+const gzipProbeSize = 64 << 20
+
+var gzipMagic = []byte{0x1f, 0x8b, 8}
+
+// scanGzipHeaders calls found with the offset of every gzip header in the first size bytes of r,
+// until it returns false.
+func scanGzipHeaders(r io.ReaderAt, size int64, found func(offset int64) bool) {
+	const chunk = 1 << 20
+	// headers that start at the end of a chunk are read with the next bytes.
+	buf := make([]byte, chunk+len(gzipMagic))
+	for off := int64(0); off < size; off += chunk {
+		n, err := r.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return
+		}
+		for i := 0; i < n && i < chunk; {
+			idx := bytes.Index(buf[i:n], gzipMagic)
+			if idx < 0 || i+idx >= chunk {
+				break
+			}
+			i += idx
+			// the reserved flags must be zero.
+			if i+len(gzipMagic) < n && buf[i+len(gzipMagic)]&0xe0 == 0 && off+int64(i) < size {
+				if !found(off + int64(i)) {
+					return
+				}
+			}
+			i++
+		}
+	}
+}
+
+// gzipMultiMember returns whether a second member starts in the first gzipProbeSize bytes of r.
+func gzipMultiMember(r io.ReaderAt, size int64) bool {
+	if size > gzipProbeSize {
+		size = gzipProbeSize
+	}
+	members := 0
+	scanGzipHeaders(r, size, func(int64) bool {
+		members++
+		return members < 2
+	})
+	return members > 1
+}
+
+// newParallelGzipReader decompresses the members of r with workers goroutines. Members bigger than
+// memberLimit are decompressed as they are read instead.
+func newParallelGzipReader(r io.ReaderAt, size int64, workers int, memberLimit int64) *parallelGzipReader {
+	p := &parallelGzipReader{
+		r:    r,
+		size: size,
+		// at most workers members are decompressed ahead of the reader.
+		results: make(chan chan gzipMemberResult, workers-1),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(p.results)
+		scanGzipHeaders(r, size, func(offset int64) bool {
+			result := make(chan gzipMemberResult, 1)
+			select {
+			case p.results <- result:
+			case <-p.done:
+				return false
+			}
+			go func() {
+				result <- decompressGzipMember(r, offset, size, memberLimit)
+			}()
+			return true
+		})
+	}()
+	return p
+}
+
+func (p *parallelGzipReader) Read(b []byte) (int, error) {
+	for len(p.buf) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		if p.member != nil {
+			n, err := p.member.Read(b)
+			if err == io.EOF {
+				p.pos, p.member, err = p.member.end(), nil, nil
+			}
+			if n > 0 || err != nil {
+				p.err = err
+				return n, err
+			}
+			continue
+		}
+
+		result, ok := <-p.results
+		if !ok {
+			p.err = io.EOF
+			if p.pos != p.size {
+				p.err = fmt.Errorf("gzip: unexpected data at offset %d", p.pos)
+			}
+			continue
+		}
+		r := <-result
+		switch {
+		case r.start < p.pos:
+			// a header in the compressed data of a member.
+		case r.start > p.pos:
+			p.err = fmt.Errorf("gzip: unexpected data at offset %d", p.pos)
+		case r.err != nil:
+			p.err = r.err
+		case r.tooBig:
+			p.member, p.err = openGzipMember(p.r, r.start, p.size)
+		default:
+			p.buf, p.pos = r.data, r.end
+		}
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+func (p *parallelGzipReader) Close() error {
+	p.once.Do(func() { close(p.done) })
+	return nil
+}
+
+// gzipMember reads a single member of a gzip file.
+type gzipMember struct {
+	*gzip.Reader
+	start int64
+	in    *countingReader
+	br    *bufio.Reader
+}
+
+func openGzipMember(r io.ReaderAt, start, size int64) (*gzipMember, error) {
+	m := &gzipMember{start: start, in: &countingReader{r: io.NewSectionReader(r, start, size-start)}}
+	// gzip doesn't buffer readers that implement io.ByteReader, so the bytes it consumed are known.
+	m.br = bufio.NewReader(m.in)
+	z, err := gzip.NewReader(m.br)
+	if err != nil {
+		return nil, err
+	}
+	z.Multistream(false)
+	m.Reader = z
+	return m, nil
+}
+
+// end returns the offset after the member, once it was read entirely.
+func (m *gzipMember) end() int64 {
+	return m.start + m.in.n - int64(m.br.Buffered())
+}
+
+// decompressGzipMember decompresses the member at start, unless it is bigger than limit.
+func decompressGzipMember(r io.ReaderAt, start, size, limit int64) gzipMemberResult {
+	m, err := openGzipMember(r, start, size)
+	if err != nil {
+		return gzipMemberResult{start: start, err: err}
+	}
+	var data bytes.Buffer
+	n, err := io.Copy(&data, io.LimitReader(m, limit+1))
+	if err != nil {
+		return gzipMemberResult{start: start, err: fmt.Errorf("gzip: can't decompress member at offset %d: %v", start, err)}
+	}
+	if n > limit {
+		return gzipMemberResult{start: start, tooBig: true}
+	}
+	return gzipMemberResult{start: start, end: m.end(), data: data.Bytes()}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
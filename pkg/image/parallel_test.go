@@ -0,0 +1,105 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParallelXz(t *testing.T) {
+	data := bytes.Repeat([]byte("arm-image"), 100000)
+	compressed := compress(t, data, newXzWriter)
+	multi := append(append(append([]byte{}, compressed...), 0, 0, 0, 0), compressed...)
+
+	f := writeTemp(t, multi)
+	streams, err := xzIndex(f, fileSize(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xzBlockCount(streams) < 4 {
+		t.Fatalf("expected multiple blocks, got %d", xzBlockCount(streams))
+	}
+
+	r := newParallelXzReader(f, streams, 3)
+	defer r.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, append(append([]byte{}, data...), data...)) {
+		t.Error("data doesn't match")
+	}
+}
+
+func TestParallelXzWorkers(t *testing.T) {
+	for _, tc := range []struct {
+		workers   int
+		blockSize uint64
+		expected  int
+	}{
+		{workers: 8, blockSize: 0, expected: 8},
+		{workers: 8, blockSize: 24 << 20, expected: 8},
+		{workers: 64, blockSize: 24 << 20, expected: 41},
+		{workers: 8, blockSize: 192 << 20, expected: 4},
+		// the blocks of two workers and the reader don't fit.
+		{workers: 8, blockSize: 512 << 20, expected: 1},
+		{workers: 8, blockSize: 2 << 30, expected: 0},
+	} {
+		if workers := parallelXzWorkers(tc.workers, tc.blockSize); workers != tc.expected {
+			t.Errorf("%d workers, %d MB blocks: got %d workers, expected %d", tc.workers, tc.blockSize>>20, workers, tc.expected)
+		}
+	}
+}
+
+func gzipLevel(level int) func(io.Writer) (io.WriteCloser, error) {
+	return func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriterLevel(w, level) }
+}
+
+func TestParallelGzip(t *testing.T) {
+	var data, multi []byte
+	for i, member := range [][]byte{
+		bytes.Repeat([]byte("arm-image"), 100000),
+		// stored as is, so the member has a gzip header in its compressed data.
+		append([]byte("a fake header: \x1f\x8b\x08\x00 "), bytes.Repeat([]byte("stored"), 1000)...),
+		{},
+		bytes.Repeat([]byte("last member"), 50000),
+	} {
+		level := gzip.DefaultCompression
+		if i == 1 {
+			level = gzip.NoCompression
+		}
+		data = append(data, member...)
+		multi = append(multi, compress(t, member, gzipLevel(level))...)
+	}
+
+	f := writeTemp(t, multi)
+	if !gzipMultiMember(f, fileSize(f)) {
+		t.Fatal("expected multiple members")
+	}
+	if gzipMultiMember(writeTemp(t, compress(t, data, gzipLevel(gzip.DefaultCompression))), int64(len(multi))) {
+		t.Error("expected a single member")
+	}
+
+	// with a small limit, the big members are decompressed by the reader.
+	for _, limit := range []int64{1 << 30, 1 << 10} {
+		r := newParallelGzipReader(f, fileSize(f), 3, limit)
+		out, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("limit %d: %v", limit, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("limit %d: data doesn't match", limit)
+		}
+	}
+
+	// trailing garbage fails, like it does with the sequential reader.
+	f = writeTemp(t, append(append([]byte{}, multi...), "garbage"...))
+	r := newParallelGzipReader(f, fileSize(f), 3, 1<<30)
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("expected an error for trailing data")
+	}
+}
@@ -0,0 +1,274 @@
+// Package simg reads and writes Android sparse images, as produced by img2simg and flashed
+// by fastboot. See system/core/libsparse/sparse_format.h in AOSP.
+package simg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	Magic = 0xed26ff3a
+
+	majorVersion    = 1
+	fileHeaderSize  = 28
+	chunkHeaderSize = 12
+
+	// BlockSize is the block size of the images written by this package.
+	BlockSize = 4096
+
+	chunkRaw      = 0xcac1
+	chunkFill     = 0xcac2
+	chunkDontCare = 0xcac3
+	chunkCrc32    = 0xcac4
+)
+
+type fileHeader struct {
+	Magic         uint32
+	MajorVersion  uint16
+	MinorVersion  uint16
+	FileHeaderSz  uint16
+	ChunkHeaderSz uint16
+	BlockSize     uint32
+	TotalBlocks   uint32
+	TotalChunks   uint32
+	ImageChecksum uint32
+}
+
+type chunkHeader struct {
+	ChunkType uint16
+	Reserved  uint16
+	ChunkSz   uint32
+	TotalSz   uint32
+}
+
+// IsSparse returns true if header is the start of an Android sparse image.
+func IsSparse(header []byte) bool {
+	return len(header) >= 4 && binary.LittleEndian.Uint32(header) == Magic
+}
+
+// Reader expands a sparse image to the raw image, reading it sequentially.
+type Reader struct {
+	r      io.Reader
+	header fileHeader
+	chunks uint32
+
+	chunkType uint16
+	// bytes left in the current chunk
+	left    int64
+	pattern [4]byte
+	// position in the current chunk, for fill chunks
+	pos int64
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	s := &Reader{r: r}
+	if err := binary.Read(r, binary.LittleEndian, &s.header); err != nil {
+		return nil, err
+	}
+	h := &s.header
+	if h.Magic != Magic || h.MajorVersion != majorVersion {
+		return nil, errors.New("simg: not an Android sparse image")
+	}
+	if h.FileHeaderSz < fileHeaderSize || h.ChunkHeaderSz < chunkHeaderSize || h.BlockSize == 0 || h.BlockSize%4 != 0 {
+		return nil, errors.New("simg: bad file header")
+	}
+	if err := s.skip(int64(h.FileHeaderSz) - fileHeaderSize); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Size is the size of the raw image.
+func (s *Reader) Size() int64 {
+	return int64(s.header.TotalBlocks) * int64(s.header.BlockSize)
+}
+
+func (s *Reader) skip(n int64) error {
+	_, err := io.CopyN(io.Discard, s.r, n)
+	return err
+}
+
+func (s *Reader) nextChunk() error {
+	var ch chunkHeader
+	if err := binary.Read(s.r, binary.LittleEndian, &ch); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if err := s.skip(int64(s.header.ChunkHeaderSz) - chunkHeaderSize); err != nil {
+		return err
+	}
+	s.chunks++
+	s.chunkType = ch.ChunkType
+	s.left = int64(ch.ChunkSz) * int64(s.header.BlockSize)
+	s.pos = 0
+	dataSize := int64(ch.TotalSz) - int64(s.header.ChunkHeaderSz)
+
+	switch ch.ChunkType {
+	case chunkRaw:
+		if dataSize != s.left {
+			return fmt.Errorf("simg: bad raw chunk size %d", ch.TotalSz)
+		}
+	case chunkFill:
+		if dataSize != 4 {
+			return fmt.Errorf("simg: bad fill chunk size %d", ch.TotalSz)
+		}
+		if _, err := io.ReadFull(s.r, s.pattern[:]); err != nil {
+			return err
+		}
+	case chunkDontCare:
+		// the content is not specified, we expand it as zeros.
+		s.pattern = [4]byte{}
+	case chunkCrc32:
+		s.left = 0
+		return s.skip(dataSize)
+	default:
+		return fmt.Errorf("simg: unknown chunk type %#x", ch.ChunkType)
+	}
+	return nil
+}
+
+func (s *Reader) Read(p []byte) (int, error) {
+	for s.left == 0 {
+		if s.chunks == s.header.TotalChunks {
+			return 0, io.EOF
+		}
+		if err := s.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > s.left {
+		p = p[:s.left]
+	}
+
+	if s.chunkType == chunkRaw {
+		n, err := s.r.Read(p)
+		s.left -= int64(n)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+	for i := range p {
+		p[i] = s.pattern[(s.pos+int64(i))%4]
+	}
+	s.pos += int64(len(p))
+	s.left -= int64(len(p))
+	return len(p), nil
+}
+
+// Write writes the raw image in src as a sparse image. Blocks filled with a repeated 32 bit value
+// (e.g. zeros) are written as fill chunks, so the expanded image is identical to the source.
+// If size is not a multiple of BlockSize, the image is padded with zeros.
+func Write(dst io.WriteSeeker, src io.Reader, size int64) error {
+	blocks := (size + BlockSize - 1) / BlockSize
+	if blocks > int64(^uint32(0)) {
+		return errors.New("simg: image is too big")
+	}
+	// the chunk count is only known at the end, the header is written again then.
+	header := fileHeader{
+		Magic:         Magic,
+		MajorVersion:  majorVersion,
+		FileHeaderSz:  fileHeaderSize,
+		ChunkHeaderSz: chunkHeaderSize,
+		BlockSize:     BlockSize,
+		TotalBlocks:   uint32(blocks),
+	}
+	if err := binary.Write(dst, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+
+	w := &chunkWriter{dst: dst}
+	block := make([]byte, BlockSize)
+	for i := int64(0); i < blocks; i++ {
+		n, err := io.ReadFull(src, block)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		for j := n; j < len(block); j++ {
+			block[j] = 0
+		}
+		if err := w.add(block); err != nil {
+			return err
+		}
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	header.TotalChunks = w.chunks
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return binary.Write(dst, binary.LittleEndian, &header)
+}
+
+// chunkWriter merges consecutive blocks of the same kind into chunks.
+type chunkWriter struct {
+	dst    io.Writer
+	chunks uint32
+
+	// the pending chunk
+	chunkType uint16
+	blocks    uint32
+	pattern   []byte
+	raw       bytes.Buffer
+}
+
+// maximum size of the raw data that is buffered before writing a chunk.
+const maxRawChunk = 16 << 20
+
+func (w *chunkWriter) add(block []byte) error {
+	chunkType := uint16(chunkRaw)
+	// the block repeats its first 4 bytes if it is equal to itself shifted by 4 bytes.
+	if bytes.Equal(block[4:], block[:len(block)-4]) {
+		chunkType = chunkFill
+	}
+
+	if w.blocks > 0 && (chunkType != w.chunkType ||
+		(chunkType == chunkFill && !bytes.Equal(block[:4], w.pattern)) ||
+		(chunkType == chunkRaw && w.raw.Len() >= maxRawChunk)) {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+
+	w.chunkType = chunkType
+	w.blocks++
+	if chunkType == chunkFill {
+		w.pattern = append(w.pattern[:0], block[:4]...)
+	} else {
+		w.raw.Write(block)
+	}
+	return nil
+}
+
+func (w *chunkWriter) flush() error {
+	if w.blocks == 0 {
+		return nil
+	}
+	data := w.pattern
+	if w.chunkType == chunkRaw {
+		data = w.raw.Bytes()
+	}
+	ch := chunkHeader{
+		ChunkType: w.chunkType,
+		ChunkSz:   w.blocks,
+		TotalSz:   uint32(chunkHeaderSize + len(data)),
+	}
+	if err := binary.Write(w.dst, binary.LittleEndian, &ch); err != nil {
+		return err
+	}
+	if _, err := w.dst.Write(data); err != nil {
+		return err
+	}
+	w.chunks++
+	w.blocks = 0
+	w.raw.Reset()
+	return nil
+}
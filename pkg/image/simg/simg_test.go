@@ -0,0 +1,48 @@
+package simg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	raw := make([]byte, 10*BlockSize+100)
+	copy(raw, bytes.Repeat([]byte("data!"), BlockSize*2/5))
+	copy(raw[4*BlockSize:], bytes.Repeat([]byte{1, 2, 3, 4}, BlockSize/4))
+	copy(raw[8*BlockSize:], bytes.Repeat([]byte("tail"), 300))
+
+	f, err := ioutil.TempFile("", "simg-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := Write(f, bytes.NewReader(raw), int64(len(raw))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != 11*BlockSize {
+		t.Errorf("wrong size %v", r.Size())
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[:len(raw)], raw) || len(data) != 11*BlockSize {
+		t.Error("data doesn't match")
+	}
+	// data, zeros, pattern, zeros, tail, zeros
+	if r.chunks != 6 {
+		t.Errorf("expected 6 chunks, got %d", r.chunks)
+	}
+}
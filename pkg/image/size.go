@@ -0,0 +1,189 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The functions in this file estimate the uncompressed size of an image from the metadata of
+// the compressed file, without decompressing it. They return 0 if the size can't be determined.
+
+func fileSize(f *os.File) int64 {
+	finfo, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	return finfo.Size()
+}
+
+var (
+	xzHeaderMagic = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
+	xzFooterMagic = []byte{'Y', 'Z'}
+)
+
+const xzHeaderFooterSize = 12
+
+// xzSizeEstimate sums the uncompressed sizes of all the blocks in the index of every
+// stream in the file.
+func xzSizeEstimate(f *os.File) uint64 {
+	streams, err := xzIndex(f, fileSize(f))
+	if err != nil {
+		return 0
+	}
+	var total uint64
+	for _, stream := range streams {
+		for _, block := range stream.blocks {
+			total += block.uncompressed
+		}
+	}
+	return total
+}
+
+type xzStream struct {
+	// offset of the stream header in the file
+	offset int64
+	header [xzHeaderFooterSize]byte
+	blocks []xzBlock
+}
+
+// xzBlock is a record of the xz index.
+type xzBlock struct {
+	unpadded     uint64
+	uncompressed uint64
+}
+
+// xzIndex reads the index of every stream in the file. Streams are walked from the end of
+// the file, using the stream footers.
+func xzIndex(r io.ReaderAt, end int64) ([]xzStream, error) {
+	var streams []xzStream
+	footer := make([]byte, xzHeaderFooterSize)
+	for end > 0 {
+		// skip stream padding
+		if _, err := r.ReadAt(footer[:4], end-4); err != nil {
+			return nil, err
+		}
+		if bytes.Equal(footer[:4], []byte{0, 0, 0, 0}) {
+			end -= 4
+			continue
+		}
+
+		if _, err := r.ReadAt(footer, end-xzHeaderFooterSize); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(footer[10:], xzFooterMagic) {
+			return nil, errors.New("xz: bad stream footer")
+		}
+		indexSize := (int64(binary.LittleEndian.Uint32(footer[4:8])) + 1) * 4
+		indexStart := end - xzHeaderFooterSize - indexSize
+		if indexStart < xzHeaderFooterSize {
+			return nil, errors.New("xz: bad index size")
+		}
+
+		index := make([]byte, indexSize)
+		if _, err := r.ReadAt(index, indexStart); err != nil {
+			return nil, err
+		}
+		blocks, err := parseXzIndex(index)
+		if err != nil {
+			return nil, err
+		}
+		var blocksSize int64
+		for _, block := range blocks {
+			// blocks are padded to a multiple of 4 bytes
+			blocksSize += int64((block.unpadded + 3) &^ 3)
+		}
+
+		end = indexStart - blocksSize - xzHeaderFooterSize
+		if end < 0 {
+			return nil, errors.New("xz: bad index")
+		}
+		stream := xzStream{offset: end, blocks: blocks}
+		if _, err := r.ReadAt(stream.header[:], end); err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(stream.header[:], xzHeaderMagic) {
+			return nil, errors.New("xz: bad stream header")
+		}
+		streams = append([]xzStream{stream}, streams...)
+	}
+	return streams, nil
+}
+
+func parseXzIndex(index []byte) ([]xzBlock, error) {
+	r := bytes.NewReader(index)
+	indicator, err := r.ReadByte()
+	if err != nil || indicator != 0 {
+		return nil, errors.New("xz: bad index indicator")
+	}
+	records, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []xzBlock
+	for i := uint64(0); i < records; i++ {
+		unpadded, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		uncompressed, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, xzBlock{unpadded: unpadded, uncompressed: uncompressed})
+	}
+	return blocks, nil
+}
+
+// deflate compresses at most about 1032:1.
+const maxDeflateRatio = 1032
+
+// gzipSizeEstimate reads the ISIZE field from the gzip trailer. ISIZE is the uncompressed
+// size modulo 2^32, and only covers the last member of a multi-member file. It is only used
+// when the file is too small to decompress to 4GB or more, as the missing high bits can't be
+// recovered: a well compressed image can be any multiple of 4GB bigger. For multi-member files
+// (e.g. concatenated gzip files) the estimate will be too small.
+func gzipSizeEstimate(f *os.File) uint64 {
+	size := fileSize(f)
+	if size < 18 || size*maxDeflateRatio >= 1<<32 {
+		return 0
+	}
+	trailer := make([]byte, 4)
+	if _, err := f.ReadAt(trailer, size-4); err != nil {
+		return 0
+	}
+	return uint64(binary.LittleEndian.Uint32(trailer))
+}
+
+// zstdSizeEstimate reads the content size from the header of the first frame, if it is present.
+// The zstd cli writes a single frame with the content size when compressing files.
+func zstdSizeEstimate(f *os.File) uint64 {
+	header := make([]byte, zstd.HeaderMaxSize)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return 0
+	}
+	var h zstd.Header
+	if err := h.Decode(header[:n]); err != nil || !h.HasFCS {
+		return 0
+	}
+	return h.FrameContentSize
+}
+
+// lz4SizeEstimate reads the optional content size from the lz4 frame descriptor.
+func lz4SizeEstimate(f *os.File) uint64 {
+	header := make([]byte, 14)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return 0
+	}
+	const contentSizeFlag = 1 << 3
+	if header[4]&contentSizeFlag == 0 {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(header[6:])
+}
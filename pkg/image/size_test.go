@@ -0,0 +1,102 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func writeTemp(t *testing.T, data []byte) *os.File {
+	f, err := ioutil.TempFile("", "size-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+		os.Remove(f.Name())
+	})
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func compress(t *testing.T, data []byte, newWriter func(io.Writer) (io.WriteCloser, error)) []byte {
+	var buf bytes.Buffer
+	w, err := newWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func newXzWriter(w io.Writer) (io.WriteCloser, error) {
+	// small blocks, so the index has multiple records
+	return xz.WriterConfig{BlockSize: 1 << 16}.NewWriter(w)
+}
+
+func TestXzSizeEstimate(t *testing.T) {
+	data := bytes.Repeat([]byte("arm-image"), 100000)
+	compressed := compress(t, data, newXzWriter)
+
+	// two concatenated streams with stream padding between them
+	multi := append([]byte{}, compressed...)
+	multi = append(multi, 0, 0, 0, 0)
+	multi = append(multi, compressed...)
+
+	if size := xzSizeEstimate(writeTemp(t, compressed)); size != uint64(len(data)) {
+		t.Errorf("expected %d got %d", len(data), size)
+	}
+	if size := xzSizeEstimate(writeTemp(t, multi)); size != 2*uint64(len(data)) {
+		t.Errorf("expected %d got %d", 2*len(data), size)
+	}
+	if size := xzSizeEstimate(writeTemp(t, data[:100])); size != 0 {
+		t.Errorf("expected no estimate for non xz file, got %d", size)
+	}
+}
+
+func TestGzipSizeEstimate(t *testing.T) {
+	data := bytes.Repeat([]byte("arm-image"), 100000)
+	compressed := compress(t, data, func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil })
+
+	if size := gzipSizeEstimate(writeTemp(t, compressed)); size != uint64(len(data)) {
+		t.Errorf("expected %d got %d", len(data), size)
+	}
+
+	// a 10GB image gzipped to 8MB: ISIZE has wrapped, and the size can't be known.
+	f := writeTemp(t, compressed)
+	wrapped := make([]byte, 4)
+	binary.LittleEndian.PutUint32(wrapped, uint32((10<<30)%(1<<32)))
+	if _, err := f.WriteAt(wrapped, 8<<20-4); err != nil {
+		t.Fatal(err)
+	}
+	if size := gzipSizeEstimate(f); size != 0 {
+		t.Errorf("expected no estimate for a wrapped ISIZE, got %d", size)
+	}
+}
+
+func TestZstdSizeEstimate(t *testing.T) {
+	data := bytes.Repeat([]byte("arm-image"), 100000)
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := enc.EncodeAll(data, nil)
+
+	if size := zstdSizeEstimate(writeTemp(t, compressed)); size != uint64(len(data)) {
+		t.Errorf("expected %d got %d", len(data), size)
+	}
+}
@@ -3,7 +3,10 @@ package utils
 import (
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
+
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/vdisk"
 )
 
 type KnownImageType string
@@ -45,6 +48,67 @@ func GuessImageType(url string) KnownImageType {
 
 }
 
+// ImageContents is what the type of an image is detected from.
+type ImageContents struct {
+	// BootFiles are the files in the root of the FAT partitions, in lower case.
+	BootFiles map[string]bool
+	// OsRelease are the fields of /etc/os-release.
+	OsRelease map[string]string
+	// ArmbianRelease is whether /etc/armbian-release exists.
+	ArmbianRelease bool
+}
+
+// ParseOsRelease returns the fields of an os-release file.
+func ParseOsRelease(data []byte) map[string]string {
+	fields := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.HasPrefix(k, "#") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(v); err == nil {
+			v = unquoted
+		} else {
+			v = strings.Trim(v, `'"`)
+		}
+		fields[k] = v
+	}
+	return fields
+}
+
+// the boot files of raspberry pi firmware, and the boot loader of beaglebones.
+var (
+	raspberryPiBootFiles = []string{"start4.elf", "start.elf", "bootcode.bin"}
+	beagleBoneBootFiles  = []string{"mlo"}
+)
+
+// DetectImageType returns the type of an image from its contents, and why. The distribution is
+// checked before the boot files, as other distributions also have raspberry pi images.
+func DetectImageType(contents ImageContents) (KnownImageType, string) {
+	if contents.ArmbianRelease {
+		return Armbian, "/etc/armbian-release exists"
+	}
+	switch id := contents.OsRelease["ID"]; id {
+	case "raspbian":
+		return RaspberryPi, "/etc/os-release has ID=" + id
+	case "kali":
+		return Kali, "/etc/os-release has ID=" + id
+	case "ubuntu":
+		return Ubuntu, "/etc/os-release has ID=" + id
+	}
+	for _, f := range raspberryPiBootFiles {
+		if contents.BootFiles[f] {
+			return RaspberryPi, "the boot partition has " + f
+		}
+	}
+	for _, f := range beagleBoneBootFiles {
+		if contents.BootFiles[f] {
+			return BeagleBone, "the boot partition has " + strings.ToUpper(f)
+		}
+	}
+	return Unknown, ""
+}
+
 func GetImageFilesInCurrentDir() []string {
 	files, err := ioutil.ReadDir(".")
 	if err != nil {
@@ -85,6 +149,20 @@ func hasPotential(info os.FileInfo) bool {
 	if strings.HasSuffix(info.Name(), ".xz") {
 		return true
 	}
+	if strings.HasSuffix(info.Name(), ".zst") {
+		return true
+	}
+	if strings.HasSuffix(info.Name(), ".lz4") {
+		return true
+	}
+	if strings.HasSuffix(info.Name(), ".simg") {
+		return true
+	}
+	for _, format := range vdisk.Formats {
+		if strings.HasSuffix(info.Name(), "."+string(format)) {
+			return true
+		}
+	}
 
 	return false
 }
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseOsRelease(t *testing.T) {
+	osRelease := `PRETTY_NAME="Raspbian GNU/Linux 11 (bullseye)"
+NAME='Raspbian GNU/Linux'
+VERSION_ID="11"
+ID=raspbian
+# a comment
+ID_LIKE=debian
+HOME_URL="http://www.raspbian.org/"
+
+not a field
+`
+	expected := map[string]string{
+		"PRETTY_NAME": "Raspbian GNU/Linux 11 (bullseye)",
+		"NAME":        "Raspbian GNU/Linux",
+		"VERSION_ID":  "11",
+		"ID":          "raspbian",
+		"ID_LIKE":     "debian",
+		"HOME_URL":    "http://www.raspbian.org/",
+	}
+	if fields := ParseOsRelease([]byte(osRelease)); !reflect.DeepEqual(fields, expected) {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+}
+
+func TestDetectImageType(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		contents ImageContents
+		expected KnownImageType
+	}{
+		{"armbian", ImageContents{OsRelease: map[string]string{"ID": "debian"}, ArmbianRelease: true}, Armbian},
+		{"raspbian", ImageContents{OsRelease: map[string]string{"ID": "raspbian"}}, RaspberryPi},
+		{"64-bit raspberry pi os", ImageContents{
+			BootFiles: map[string]bool{"start4.elf": true, "config.txt": true},
+			OsRelease: map[string]string{"ID": "debian"},
+		}, RaspberryPi},
+		// the distribution comes before the raspberry pi firmware.
+		{"ubuntu for raspberry pi", ImageContents{
+			BootFiles: map[string]bool{"start4.elf": true},
+			OsRelease: map[string]string{"ID": "ubuntu"},
+		}, Ubuntu},
+		{"kali", ImageContents{
+			BootFiles: map[string]bool{"bootcode.bin": true},
+			OsRelease: map[string]string{"ID": "kali"},
+		}, Kali},
+		{"beaglebone", ImageContents{
+			BootFiles: map[string]bool{"mlo": true, "u-boot.img": true},
+			OsRelease: map[string]string{"ID": "debian"},
+		}, BeagleBone},
+		{"unknown", ImageContents{OsRelease: map[string]string{"ID": "debian"}}, Unknown},
+		{"empty", ImageContents{}, Unknown},
+	} {
+		detected, reason := DetectImageType(test.contents)
+		if detected != test.expected {
+			t.Errorf("%s: detected %q (%s), expected %q", test.name, detected, reason, test.expected)
+		}
+		if detected != Unknown && reason == "" {
+			t.Errorf("%s: no reason", test.name)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package vdisk
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// See https://gitlab.com/qemu-project/qemu/-/blob/master/docs/interop/qcow2.txt
+
+const (
+	qcow2Magic = "QFI\xfb"
+
+	qcow2V2HeaderSize = 72
+	qcow2V3HeaderSize = 104
+
+	qcow2OffsetMask      = 0x00fffffffffffe00
+	qcow2Copied          = 1 << 63
+	qcow2Compressed      = 1 << 62
+	qcow2ZeroCluster     = 1
+	qcow2ClusterBits     = 16
+	qcow2RefcountOrder   = 4
+	qcow2CompressionZstd = 1
+
+	// incompatible feature bits
+	qcow2FeatureExternalData    = 1 << 2
+	qcow2FeatureCompressionType = 1 << 3
+	qcow2FeatureExtendedL2      = 1 << 4
+)
+
+type qcow2Header struct {
+	Magic                 [4]byte
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+	// version 3 only
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+	RefcountOrder        uint32
+	HeaderLength         uint32
+}
+
+type qcow2Reader struct {
+	r           io.ReaderAt
+	fileSize    int64
+	header      qcow2Header
+	clusterSize int64
+	compression byte
+	l1          []uint64
+
+	l2Index int
+	l2      []uint64
+
+	// the last compressed cluster that was read
+	cachedIndex   int64
+	cachedCluster []byte
+}
+
+func openQcow2(r io.ReaderAt, fileSize int64) (Disk, error) {
+	raw := make([]byte, qcow2V3HeaderSize+1)
+	if err := readFull(r, raw[:qcow2V2HeaderSize], 0); err != nil {
+		return nil, err
+	}
+	q := &qcow2Reader{r: r, fileSize: fileSize, l2Index: -1, cachedIndex: -1}
+	h := &q.header
+	if err := binary.Read(bytes.NewReader(raw), binary.BigEndian, h); err != nil {
+		return nil, err
+	}
+	switch h.Version {
+	case 2:
+		h.IncompatibleFeatures = 0
+	case 3:
+		if err := readFull(r, raw, 0); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(bytes.NewReader(raw), binary.BigEndian, h); err != nil {
+			return nil, err
+		}
+		if h.IncompatibleFeatures&qcow2FeatureCompressionType != 0 {
+			q.compression = raw[qcow2V3HeaderSize]
+		}
+	default:
+		return nil, fmt.Errorf("qcow2: unsupported version %d", h.Version)
+	}
+
+	switch {
+	case h.BackingFileOffset != 0:
+		return nil, errors.New("qcow2: images with a backing file are not supported")
+	case h.CryptMethod != 0:
+		return nil, errors.New("qcow2: encrypted images are not supported")
+	case h.IncompatibleFeatures&(qcow2FeatureExternalData|qcow2FeatureExtendedL2) != 0:
+		return nil, fmt.Errorf("qcow2: unsupported features %#x", h.IncompatibleFeatures)
+	case h.ClusterBits < 9 || h.ClusterBits > 21:
+		return nil, fmt.Errorf("qcow2: bad cluster size 2^%d", h.ClusterBits)
+	case q.compression > qcow2CompressionZstd:
+		return nil, fmt.Errorf("qcow2: unsupported compression type %d", q.compression)
+	}
+	q.clusterSize = 1 << h.ClusterBits
+
+	l1 := make([]byte, int64(h.L1Size)*8)
+	if err := readFull(r, l1, int64(h.L1TableOffset)); err != nil {
+		return nil, fmt.Errorf("qcow2: can't read L1 table: %v", err)
+	}
+	q.l1 = make([]uint64, h.L1Size)
+	for i := range q.l1 {
+		q.l1[i] = binary.BigEndian.Uint64(l1[i*8:])
+	}
+
+	return &blockDisk{size: int64(h.Size), blockSize: q.clusterSize, readBlock: q.readCluster}, nil
+}
+
+func (q *qcow2Reader) l2Entry(cluster int64) (uint64, error) {
+	l2Entries := q.clusterSize / 8
+	l1Index := int(cluster / l2Entries)
+	if l1Index >= len(q.l1) {
+		return 0, nil
+	}
+	if l1Index != q.l2Index {
+		offset := int64(q.l1[l1Index] & qcow2OffsetMask)
+		if offset == 0 {
+			return 0, nil
+		}
+		raw := make([]byte, q.clusterSize)
+		if err := readFull(q.r, raw, offset); err != nil {
+			return 0, fmt.Errorf("qcow2: can't read L2 table: %v", err)
+		}
+		q.l2 = make([]uint64, l2Entries)
+		for i := range q.l2 {
+			q.l2[i] = binary.BigEndian.Uint64(raw[i*8:])
+		}
+		q.l2Index = l1Index
+	}
+	return q.l2[cluster%l2Entries], nil
+}
+
+func (q *qcow2Reader) readCluster(cluster int64, buf []byte, off int64) error {
+	entry, err := q.l2Entry(cluster)
+	if err != nil {
+		return err
+	}
+	if entry&qcow2Compressed != 0 {
+		if q.cachedIndex != cluster {
+			if err := q.decompress(entry); err != nil {
+				return err
+			}
+			q.cachedIndex = cluster
+		}
+		copy(buf, q.cachedCluster[off:])
+		return nil
+	}
+
+	offset := int64(entry & qcow2OffsetMask)
+	if offset == 0 || (q.header.Version >= 3 && entry&qcow2ZeroCluster != 0) {
+		zeros(buf)
+		return nil
+	}
+	return readFull(q.r, buf, offset+off)
+}
+
+func (q *qcow2Reader) decompress(entry uint64) error {
+	x := 62 - (q.header.ClusterBits - 8)
+	offset := int64(entry & (1<<x - 1))
+	sectors := int64(entry>>x) & (1<<(62-x) - 1)
+	size := (sectors+1)*SectorSize - offset%SectorSize
+	if offset+size > q.fileSize {
+		// the last compressed cluster may end before its last sector.
+		size = q.fileSize - offset
+	}
+	compressed := make([]byte, size)
+	if err := readFull(q.r, compressed, offset); err != nil {
+		return err
+	}
+
+	var r io.Reader
+	if q.compression == qcow2CompressionZstd {
+		d, err := zstd.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		r = d
+	} else {
+		r = flate.NewReader(bytes.NewReader(compressed))
+	}
+
+	if q.cachedCluster == nil {
+		q.cachedCluster = make([]byte, q.clusterSize)
+	}
+	n, err := io.ReadFull(r, q.cachedCluster)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("qcow2: can't decompress cluster: %v", err)
+	}
+	zeros(q.cachedCluster[n:])
+	return nil
+}
+
+// writeQcow2 writes a version 3 image. The metadata is allocated before the data:
+//
+//	header | L1 table | refcount table | refcount blocks | L2 tables and data clusters
+func writeQcow2(dst *os.File, src io.Reader, size int64) error {
+	const clusterSize = 1 << qcow2ClusterBits
+	const l2Entries = clusterSize / 8
+	const refcountEntries = clusterSize * 8 / (1 << qcow2RefcountOrder)
+
+	clusters := divRoundUp(size, clusterSize)
+	l1Size := divRoundUp(clusters, l2Entries)
+	l1Clusters := divRoundUp(l1Size*8, clusterSize)
+
+	// allocate refcount blocks for the worst case, where every cluster holds data.
+	var rtClusters, rbClusters int64
+	for {
+		total := 1 + l1Clusters + rtClusters + rbClusters + l1Size + clusters
+		rb := divRoundUp(total, refcountEntries)
+		rt := divRoundUp(rb*8, clusterSize)
+		if rb == rbClusters && rt == rtClusters {
+			break
+		}
+		rbClusters, rtClusters = rb, rt
+	}
+
+	l1Offset := int64(clusterSize)
+	rtOffset := l1Offset + l1Clusters*clusterSize
+	rbOffset := rtOffset + rtClusters*clusterSize
+	next := rbOffset + rbClusters*clusterSize
+
+	l2Offsets := make([]int64, l1Size)
+	l2Tables := make([][]uint64, l1Size)
+	blocks := newBlockSource(src, size, clusterSize)
+	for {
+		index, data, err := blocks.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		l1Index := index / l2Entries
+		if l2Tables[l1Index] == nil {
+			l2Tables[l1Index] = make([]uint64, l2Entries)
+			l2Offsets[l1Index] = next
+			next += clusterSize
+		}
+		if _, err := dst.WriteAt(data, next); err != nil {
+			return err
+		}
+		l2Tables[l1Index][index%l2Entries] = uint64(next) | qcow2Copied
+		next += clusterSize
+	}
+
+	l1 := make([]byte, l1Clusters*clusterSize)
+	for i, table := range l2Tables {
+		if table == nil {
+			continue
+		}
+		raw := make([]byte, clusterSize)
+		for j, entry := range table {
+			binary.BigEndian.PutUint64(raw[j*8:], entry)
+		}
+		if _, err := dst.WriteAt(raw, l2Offsets[i]); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint64(l1[i*8:], uint64(l2Offsets[i])|qcow2Copied)
+	}
+	if _, err := dst.WriteAt(l1, l1Offset); err != nil {
+		return err
+	}
+
+	// every cluster in the file is in use.
+	rt := make([]byte, rtClusters*clusterSize)
+	rb := make([]byte, rbClusters*clusterSize)
+	for i := int64(0); i < rbClusters; i++ {
+		binary.BigEndian.PutUint64(rt[i*8:], uint64(rbOffset+i*clusterSize))
+	}
+	for c := int64(0); c < next/clusterSize; c++ {
+		binary.BigEndian.PutUint16(rb[c*2:], 1)
+	}
+	if _, err := dst.WriteAt(rt, rtOffset); err != nil {
+		return err
+	}
+	if _, err := dst.WriteAt(rb, rbOffset); err != nil {
+		return err
+	}
+
+	header := qcow2Header{
+		Version:               3,
+		ClusterBits:           qcow2ClusterBits,
+		Size:                  uint64(size),
+		L1Size:                uint32(l1Size),
+		L1TableOffset:         uint64(l1Offset),
+		RefcountTableOffset:   uint64(rtOffset),
+		RefcountTableClusters: uint32(rtClusters),
+		RefcountOrder:         qcow2RefcountOrder,
+		HeaderLength:          qcow2V3HeaderSize,
+	}
+	copy(header.Magic[:], qcow2Magic)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &header)
+	// an empty header extension ends the list of extensions.
+	buf.Write(make([]byte, 8))
+	if _, err := dst.WriteAt(buf.Bytes(), 0); err != nil {
+		return err
+	}
+	return dst.Truncate(next)
+}
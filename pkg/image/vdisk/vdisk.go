@@ -0,0 +1,204 @@
+// Package vdisk reads and writes the disk image formats of virtual machines (qcow2, VMDK,
+// VHD and VHDX) in pure go. Only standalone images are supported: no backing files,
+// snapshots, encryption or split extents.
+package vdisk
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const SectorSize = 512
+
+type Format string
+
+const (
+	Qcow2 Format = "qcow2"
+	VMDK  Format = "vmdk"
+	VHD   Format = "vhd"
+	VHDX  Format = "vhdx"
+)
+
+var Formats = []Format{Qcow2, VMDK, VHD, VHDX}
+
+// Disk is the content of a virtual disk, as a raw disk image.
+type Disk interface {
+	io.ReaderAt
+	// Size is the virtual size of the disk in bytes.
+	Size() int64
+}
+
+// Detect returns the format of the file that starts with header, or "" if it is not a
+// virtual disk. Fixed size VHD files are not detected, as they are a raw image with a footer.
+func Detect(header []byte) Format {
+	switch {
+	case bytes.HasPrefix(header, []byte(qcow2Magic)):
+		return Qcow2
+	case bytes.HasPrefix(header, []byte(vmdkMagic)):
+		return VMDK
+	case bytes.HasPrefix(header, []byte(vhdCookie)):
+		return VHD
+	case bytes.HasPrefix(header, []byte(vhdxSignature)):
+		return VHDX
+	}
+	return ""
+}
+
+// Open reads the metadata of the virtual disk in r.
+func Open(r io.ReaderAt, fileSize int64) (Disk, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	switch Detect(header) {
+	case Qcow2:
+		return openQcow2(r, fileSize)
+	case VMDK:
+		return openVmdk(r, fileSize)
+	case VHD:
+		return openVhd(r, fileSize)
+	case VHDX:
+		return openVhdx(r, fileSize)
+	}
+	return nil, errors.New("unknown virtual disk format")
+}
+
+// Write converts the raw disk image in src to format. Runs of zeros are not allocated in the
+// output. size is the size of the disk, src may be shorter than that.
+func Write(dst *os.File, src io.Reader, size int64, format Format) error {
+	switch format {
+	case Qcow2:
+		return writeQcow2(dst, src, size)
+	case VMDK:
+		return writeVmdk(dst, src, size)
+	case VHD:
+		return writeVhd(dst, src, size)
+	case VHDX:
+		return writeVhdx(dst, src, size)
+	}
+	return fmt.Errorf("unknown virtual disk format %q", format)
+}
+
+// blockSource reads the source image one block at a time.
+type blockSource struct {
+	src       io.Reader
+	size      int64
+	blockSize int64
+	offset    int64
+	buf       []byte
+}
+
+func newBlockSource(src io.Reader, size, blockSize int64) *blockSource {
+	return &blockSource{src: src, size: size, blockSize: blockSize, buf: make([]byte, blockSize)}
+}
+
+// next returns the index of the next block and its data, which is nil if the block is
+// all zeros. It returns io.EOF after the last block of the disk.
+func (b *blockSource) next() (int64, []byte, error) {
+	if b.offset >= b.size {
+		// the source must not have more data than the disk.
+		var extra [1]byte
+		if n, _ := io.ReadFull(b.src, extra[:]); n != 0 {
+			return 0, nil, fmt.Errorf("image is bigger than the disk size (%v bytes)", b.size)
+		}
+		return 0, nil, io.EOF
+	}
+	index := b.offset / b.blockSize
+	n, err := io.ReadFull(b.src, b.buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, nil, err
+	}
+	for i := n; i < len(b.buf); i++ {
+		b.buf[i] = 0
+	}
+	b.offset += b.blockSize
+	if isZero(b.buf) {
+		return index, nil, nil
+	}
+	return index, b.buf, nil
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// readFull reads len(buf) bytes at off. Reading past the end of the file is an error,
+// as it means the metadata is corrupted.
+func readFull(r io.ReaderAt, buf []byte, off int64) error {
+	n, err := r.ReadAt(buf, off)
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func zeros(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
+
+func divRoundUp(a, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+func roundUp(a, b int64) int64 {
+	return divRoundUp(a, b) * b
+}
+
+func newGUID() [16]byte {
+	var guid [16]byte
+	rand.Read(guid[:])
+	// version 4, variant 1
+	guid[7] = guid[7]&0x0f | 0x40
+	guid[8] = guid[8]&0x3f | 0x80
+	return guid
+}
+
+// blockDisk implements Disk for formats that allocate the disk in blocks (clusters, grains).
+type blockDisk struct {
+	size      int64
+	blockSize int64
+	// readBlock reads len(buf) bytes of block index, starting at off in the block.
+	readBlock func(index int64, buf []byte, off int64) error
+}
+
+func (d *blockDisk) Size() int64 { return d.size }
+
+func (d *blockDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off >= d.size {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && off < d.size {
+		inBlock := off % d.blockSize
+		chunk := int64(len(p) - n)
+		if chunk > d.blockSize-inBlock {
+			chunk = d.blockSize - inBlock
+		}
+		if chunk > d.size-off {
+			chunk = d.size - off
+		}
+		if err := d.readBlock(off/d.blockSize, p[n:n+int(chunk)], inBlock); err != nil {
+			return n, err
+		}
+		n += int(chunk)
+		off += chunk
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
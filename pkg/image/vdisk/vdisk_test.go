@@ -0,0 +1,114 @@
+package vdisk
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testDisk has data at the start, a hole, and data ending in the middle of a block.
+func testDisk() []byte {
+	disk := make([]byte, 5<<20+3*SectorSize)
+	copy(disk, bytes.Repeat([]byte("boot"), 1000))
+	copy(disk[4<<20+100:], bytes.Repeat([]byte("root"), 100000))
+	return disk
+}
+
+func TestRoundTrip(t *testing.T) {
+	disk := testDisk()
+	for _, format := range Formats {
+		f, err := os.Create(filepath.Join(t.TempDir(), "disk."+string(format)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if err := Write(f, bytes.NewReader(disk), int64(len(disk)), format); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		header := make([]byte, 8)
+		f.ReadAt(header, 0)
+		if Detect(header) != format {
+			t.Errorf("%s: detected as %q", format, Detect(header))
+		}
+
+		finfo, _ := f.Stat()
+		d, err := Open(f, finfo.Size())
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if d.Size() < int64(len(disk)) {
+			t.Fatalf("%s: disk is too small: %v", format, d.Size())
+		}
+		data, err := io.ReadAll(io.NewSectionReader(d, 0, d.Size()))
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if !bytes.Equal(data[:len(disk)], disk) || !isZero(data[len(disk):]) {
+			t.Errorf("%s: data doesn't match", format)
+		}
+	}
+}
+
+func TestWriteTooBig(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "disk.qcow2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := Write(f, bytes.NewReader(testDisk()), 1<<20, Qcow2); err == nil {
+		t.Error("expected an error for a source bigger than the disk")
+	}
+}
+
+func TestQcow2CompressedCluster(t *testing.T) {
+	const clusterSize = 1 << qcow2ClusterBits
+	disk := make([]byte, 2*clusterSize)
+	copy(disk, "first")
+	cluster := bytes.Repeat([]byte("compressed"), clusterSize/10+1)[:clusterSize]
+	copy(disk[clusterSize:], cluster)
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "disk.qcow2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := Write(f, bytes.NewReader(disk[:clusterSize]), int64(len(disk)), Qcow2); err != nil {
+		t.Fatal(err)
+	}
+
+	// append the second cluster compressed, and point its L2 entry to it.
+	var compressed bytes.Buffer
+	w, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	w.Write(cluster)
+	w.Close()
+	finfo, _ := f.Stat()
+	offset := finfo.Size() + 100
+	f.WriteAt(compressed.Bytes(), offset)
+	sectors := (offset%SectorSize+int64(compressed.Len())+SectorSize-1)/SectorSize - 1
+	x := 62 - (qcow2ClusterBits - 8)
+	entry := uint64(qcow2Compressed) | uint64(sectors)<<x | uint64(offset)
+
+	raw := make([]byte, 8)
+	f.ReadAt(raw, clusterSize)
+	l2 := int64(binary.BigEndian.Uint64(raw) & qcow2OffsetMask)
+	binary.BigEndian.PutUint64(raw, entry)
+	f.WriteAt(raw, l2+8)
+
+	finfo, _ = f.Stat()
+	d, err := Open(f, finfo.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(io.NewSectionReader(d, 0, d.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, disk) {
+		t.Error("data doesn't match")
+	}
+}
@@ -0,0 +1,259 @@
+package vdisk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// See the "Virtual Hard Disk Image Format Specification" from Microsoft. Only dynamic disks
+// are supported, fixed disks are read as raw images.
+
+const (
+	vhdCookie        = "conectix"
+	vhdDynamicCookie = "cxsparse"
+
+	vhdVersion       = 0x00010000
+	vhdFeatures      = 2
+	vhdFixedOffset   = 0xffffffffffffffff
+	vhdTypeDynamic   = 3
+	vhdUnusedBlock   = 0xffffffff
+	vhdBlockSize     = 2 << 20
+	vhdHeaderSize    = 1024
+	vhdMaxCHSSectors = 65535 * 16 * 255
+)
+
+type vhdFooter struct {
+	Cookie             [8]byte
+	Features           uint32
+	FileFormatVersion  uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      [4]byte
+	OriginalSize       uint64
+	CurrentSize        uint64
+	Cylinders          uint16
+	Heads              uint8
+	SectorsPerTrack    uint8
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+type vhdDynamicHeader struct {
+	Cookie               [8]byte
+	DataOffset           uint64
+	TableOffset          uint64
+	HeaderVersion        uint32
+	MaxTableEntries      uint32
+	BlockSize            uint32
+	Checksum             uint32
+	ParentUniqueID       [16]byte
+	ParentTimeStamp      uint32
+	Reserved1            uint32
+	ParentUnicodeName    [512]byte
+	ParentLocatorEntries [8][24]byte
+	Reserved2            [256]byte
+}
+
+// vhdChecksum is the one's complement of the sum of the bytes, without the checksum field.
+func vhdChecksum(raw []byte, checksumOffset int) uint32 {
+	var sum uint32
+	for i, b := range raw {
+		if i >= checksumOffset && i < checksumOffset+4 {
+			continue
+		}
+		sum += uint32(b)
+	}
+	return ^sum
+}
+
+type vhdReader struct {
+	r             io.ReaderAt
+	bat           []uint32
+	bitmapSectors int64
+}
+
+func openVhd(r io.ReaderAt, fileSize int64) (Disk, error) {
+	raw := make([]byte, SectorSize)
+	if err := readFull(r, raw, 0); err != nil {
+		return nil, err
+	}
+	var footer vhdFooter
+	if err := binary.Read(bytes.NewReader(raw), binary.BigEndian, &footer); err != nil {
+		return nil, err
+	}
+	if vhdChecksum(raw, 64) != footer.Checksum {
+		return nil, errors.New("vhd: bad footer checksum")
+	}
+	if footer.DiskType != vhdTypeDynamic {
+		return nil, fmt.Errorf("vhd: unsupported disk type %d", footer.DiskType)
+	}
+
+	raw = make([]byte, vhdHeaderSize)
+	if err := readFull(r, raw, int64(footer.DataOffset)); err != nil {
+		return nil, err
+	}
+	var header vhdDynamicHeader
+	if err := binary.Read(bytes.NewReader(raw), binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if string(header.Cookie[:]) != vhdDynamicCookie {
+		return nil, errors.New("vhd: bad dynamic disk header")
+	}
+	if header.BlockSize == 0 || header.BlockSize%SectorSize != 0 {
+		return nil, fmt.Errorf("vhd: bad block size %d", header.BlockSize)
+	}
+
+	v := &vhdReader{r: r, bitmapSectors: divRoundUp(int64(header.BlockSize)/SectorSize/8, SectorSize)}
+	raw = make([]byte, int64(header.MaxTableEntries)*4)
+	if err := readFull(r, raw, int64(header.TableOffset)); err != nil {
+		return nil, fmt.Errorf("vhd: can't read block allocation table: %v", err)
+	}
+	v.bat = make([]uint32, header.MaxTableEntries)
+	for i := range v.bat {
+		v.bat[i] = binary.BigEndian.Uint32(raw[i*4:])
+	}
+
+	return &blockDisk{size: int64(footer.CurrentSize), blockSize: int64(header.BlockSize), readBlock: v.readBlock}, nil
+}
+
+func (v *vhdReader) readBlock(index int64, buf []byte, off int64) error {
+	if index >= int64(len(v.bat)) || v.bat[index] == vhdUnusedBlock {
+		zeros(buf)
+		return nil
+	}
+	// the data follows the bitmap of the sectors present in the block. We ignore the bitmap,
+	// as the sectors that are not present are zeros in dynamic disks.
+	return readFull(v.r, buf, (int64(v.bat[index])+v.bitmapSectors)*SectorSize+off)
+}
+
+// vhdGeometry computes the CHS geometry of the disk, following the algorithm of the specification.
+func vhdGeometry(totalSectors int64) (cylinders int64, heads int64, sectorsPerTrack int64) {
+	if totalSectors > vhdMaxCHSSectors {
+		totalSectors = vhdMaxCHSSectors
+	}
+	var cylinderTimesHeads int64
+	if totalSectors >= 65535*16*63 {
+		sectorsPerTrack = 255
+		heads = 16
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+	} else {
+		sectorsPerTrack = 17
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+		heads = (cylinderTimesHeads + 1023) / 1024
+		if heads < 4 {
+			heads = 4
+		}
+		if cylinderTimesHeads >= heads*1024 || heads > 16 {
+			sectorsPerTrack = 31
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+		if cylinderTimesHeads >= heads*1024 {
+			sectorsPerTrack = 63
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+	}
+	return cylinderTimesHeads / heads, heads, sectorsPerTrack
+}
+
+// writeVhd writes a dynamic disk:
+//
+//	footer copy | dynamic disk header | block allocation table | blocks | footer
+func writeVhd(dst *os.File, src io.Reader, size int64) error {
+	// some readers (e.g. Virtual PC and qemu) take the size of the disk from its geometry,
+	// so the disk is grown to the next size that has an exact geometry.
+	totalSectors := divRoundUp(size, SectorSize)
+	c, h, s := vhdGeometry(totalSectors)
+	if totalSectors <= vhdMaxCHSSectors {
+		for i := int64(1); c*h*s < totalSectors; i++ {
+			c, h, s = vhdGeometry(totalSectors + i)
+		}
+		totalSectors = c * h * s
+	}
+	diskSize := totalSectors * SectorSize
+
+	entries := divRoundUp(diskSize, vhdBlockSize)
+	batOffset := int64(SectorSize + vhdHeaderSize)
+	batSize := roundUp(entries*4, SectorSize)
+	bat := bytes.Repeat([]byte{0xff}, int(batSize))
+	bitmap := bytes.Repeat([]byte{0xff}, SectorSize)
+
+	next := batOffset + batSize
+	blocks := newBlockSource(src, diskSize, vhdBlockSize)
+	for {
+		index, data, err := blocks.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		if _, err := dst.WriteAt(append(bitmap, data...), next); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(bat[index*4:], uint32(next/SectorSize))
+		next += SectorSize + vhdBlockSize
+	}
+	if _, err := dst.WriteAt(bat, batOffset); err != nil {
+		return err
+	}
+
+	header := vhdDynamicHeader{
+		DataOffset:      vhdFixedOffset,
+		TableOffset:     uint64(batOffset),
+		HeaderVersion:   vhdVersion,
+		MaxTableEntries: uint32(entries),
+		BlockSize:       vhdBlockSize,
+	}
+	copy(header.Cookie[:], vhdDynamicCookie)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &header)
+	raw := buf.Bytes()
+	binary.BigEndian.PutUint32(raw[36:], vhdChecksum(raw, 36))
+	if _, err := dst.WriteAt(raw, SectorSize); err != nil {
+		return err
+	}
+
+	footer := vhdFooter{
+		Features:          vhdFeatures,
+		FileFormatVersion: vhdVersion,
+		DataOffset:        SectorSize,
+		TimeStamp:         uint32(time.Since(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)).Seconds()),
+		CreatorVersion:    vhdVersion,
+		OriginalSize:      uint64(diskSize),
+		CurrentSize:       uint64(diskSize),
+		Cylinders:         uint16(c),
+		Heads:             uint8(h),
+		SectorsPerTrack:   uint8(s),
+		DiskType:          vhdTypeDynamic,
+		UniqueID:          newGUID(),
+	}
+	copy(footer.Cookie[:], vhdCookie)
+	copy(footer.CreatorApplication[:], "pkr ")
+	copy(footer.CreatorHostOS[:], "Wi2k")
+	buf.Reset()
+	binary.Write(&buf, binary.BigEndian, &footer)
+	raw = buf.Bytes()
+	binary.BigEndian.PutUint32(raw[64:], vhdChecksum(raw, 64))
+	if _, err := dst.WriteAt(raw, 0); err != nil {
+		return err
+	}
+	if _, err := dst.WriteAt(raw, next); err != nil {
+		return err
+	}
+	return dst.Truncate(next + SectorSize)
+}
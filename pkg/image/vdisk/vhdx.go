@@ -0,0 +1,403 @@
+package vdisk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// See the "VHDX Format Specification" from Microsoft. Images with a log that needs to be
+// replayed and differencing disks are not supported.
+
+const (
+	vhdxSignature         = "vhdxfile"
+	vhdxHeaderSignature   = "head"
+	vhdxRegionSignature   = "regi"
+	vhdxMetadataSignature = "metadata"
+
+	mb = 1 << 20
+
+	vhdxHeaderOffset       = 64 << 10
+	vhdxHeaderSize         = 4 << 10
+	vhdxRegionTableOffset  = 192 << 10
+	vhdxRegionTableSize    = 64 << 10
+	vhdxLogOffset          = 1 * mb
+	vhdxLogSize            = 1 * mb
+	vhdxMetadataOffset     = 2 * mb
+	vhdxMetadataSize       = 1 * mb
+	vhdxMetadataItemOffset = 64 << 10
+	vhdxBatOffset          = 3 * mb
+	vhdxBlockSize          = 2 * mb
+	vhdxLogicalSectorSize  = SectorSize
+	vhdxPhysicalSectorSize = 4096
+
+	vhdxBlockStateMask     = 7
+	vhdxBlockFullyPresent  = 6
+	vhdxBlockPartial       = 7
+	vhdxFileHasParent      = 1 << 1
+	vhdxRegionRequired     = 1
+	vhdxMetadataIsVirtual  = 1 << 1
+	vhdxMetadataIsRequired = 1 << 2
+)
+
+var (
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+	vhdxBatRegion      = mustGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxMetadataRegion = mustGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+
+	vhdxItemFileParameters     = mustGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxItemVirtualDiskSize    = mustGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxItemVirtualDiskID      = mustGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	vhdxItemLogicalSectorSize  = mustGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	vhdxItemPhysicalSectorSize = mustGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+)
+
+// mustGUID encodes a GUID in the mixed endian format used by Microsoft.
+func mustGUID(s string) [16]byte {
+	raw, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(raw) != 16 {
+		panic("bad guid " + s)
+	}
+	var guid [16]byte
+	binary.LittleEndian.PutUint32(guid[0:], binary.BigEndian.Uint32(raw[0:]))
+	binary.LittleEndian.PutUint16(guid[4:], binary.BigEndian.Uint16(raw[4:]))
+	binary.LittleEndian.PutUint16(guid[6:], binary.BigEndian.Uint16(raw[6:]))
+	copy(guid[8:], raw[8:])
+	return guid
+}
+
+type vhdxHeader struct {
+	Signature      [4]byte
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGuid  [16]byte
+	DataWriteGuid  [16]byte
+	LogGuid        [16]byte
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+}
+
+type vhdxRegionTableHeader struct {
+	Signature  [4]byte
+	Checksum   uint32
+	EntryCount uint32
+	Reserved   uint32
+}
+
+type vhdxRegionTableEntry struct {
+	Guid       [16]byte
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+type vhdxMetadataTableHeader struct {
+	Signature  [8]byte
+	Reserved   uint16
+	EntryCount uint16
+	Reserved2  [20]byte
+}
+
+type vhdxMetadataTableEntry struct {
+	ItemId   [16]byte
+	Offset   uint32
+	Length   uint32
+	Flags    uint32
+	Reserved uint32
+}
+
+// vhdxChecksum computes the crc32c of the structure, with its checksum field (at offset 4) zeroed.
+func vhdxChecksum(raw []byte) uint32 {
+	saved := binary.LittleEndian.Uint32(raw[4:])
+	binary.LittleEndian.PutUint32(raw[4:], 0)
+	sum := crc32.Checksum(raw, crc32c)
+	binary.LittleEndian.PutUint32(raw[4:], saved)
+	return sum
+}
+
+// readVhdxStruct reads a structure of size bytes at off, and checks its signature and checksum.
+func readVhdxStruct(r io.ReaderAt, off, size int64, signature string, v interface{}) ([]byte, error) {
+	raw := make([]byte, size)
+	if err := readFull(r, raw, off); err != nil {
+		return nil, err
+	}
+	if string(raw[:len(signature)]) != signature {
+		return nil, fmt.Errorf("vhdx: bad %q signature", signature)
+	}
+	if vhdxChecksum(raw) != binary.LittleEndian.Uint32(raw[4:]) {
+		return nil, fmt.Errorf("vhdx: bad %q checksum", signature)
+	}
+	return raw, binary.Read(bytes.NewReader(raw), binary.LittleEndian, v)
+}
+
+type vhdxReader struct {
+	r          io.ReaderAt
+	bat        []uint64
+	chunkRatio int64
+}
+
+func openVhdx(r io.ReaderAt, fileSize int64) (Disk, error) {
+	// there are two copies of the header, the current one has the highest sequence number.
+	var header *vhdxHeader
+	for i := int64(0); i < 2; i++ {
+		var h vhdxHeader
+		if _, err := readVhdxStruct(r, vhdxHeaderOffset*(i+1), vhdxHeaderSize, vhdxHeaderSignature, &h); err != nil {
+			continue
+		}
+		if header == nil || h.SequenceNumber > header.SequenceNumber {
+			header = &h
+		}
+	}
+	if header == nil {
+		return nil, errors.New("vhdx: no valid header")
+	}
+	if header.LogGuid != [16]byte{} {
+		return nil, errors.New("vhdx: the image has a log that needs to be replayed, open it with Hyper-V or qemu first")
+	}
+
+	var batRegion, metadataRegion *vhdxRegionTableEntry
+	var raw []byte
+	var err error
+	var regions vhdxRegionTableHeader
+	for i := int64(0); i < 2; i++ {
+		raw, err = readVhdxStruct(r, vhdxRegionTableOffset+i*vhdxRegionTableSize, vhdxRegionTableSize, vhdxRegionSignature, &regions)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := bytes.NewReader(raw[16:])
+	for i := uint32(0); i < regions.EntryCount; i++ {
+		entry := new(vhdxRegionTableEntry)
+		if err := binary.Read(entries, binary.LittleEndian, entry); err != nil {
+			return nil, err
+		}
+		switch entry.Guid {
+		case vhdxBatRegion:
+			batRegion = entry
+		case vhdxMetadataRegion:
+			metadataRegion = entry
+		default:
+			if entry.Required&vhdxRegionRequired != 0 {
+				return nil, errors.New("vhdx: unknown required region")
+			}
+		}
+	}
+	if batRegion == nil || metadataRegion == nil {
+		return nil, errors.New("vhdx: missing region")
+	}
+
+	metadata, err := readVhdxMetadata(r, metadataRegion)
+	if err != nil {
+		return nil, err
+	}
+	if len(metadata[vhdxItemFileParameters]) < 8 || len(metadata[vhdxItemVirtualDiskSize]) < 8 || len(metadata[vhdxItemLogicalSectorSize]) < 4 {
+		return nil, errors.New("vhdx: missing metadata")
+	}
+	blockSize := int64(binary.LittleEndian.Uint32(metadata[vhdxItemFileParameters]))
+	if binary.LittleEndian.Uint32(metadata[vhdxItemFileParameters][4:])&vhdxFileHasParent != 0 {
+		return nil, errors.New("vhdx: differencing disks are not supported")
+	}
+	size := int64(binary.LittleEndian.Uint64(metadata[vhdxItemVirtualDiskSize]))
+	logicalSectorSize := int64(binary.LittleEndian.Uint32(metadata[vhdxItemLogicalSectorSize]))
+	if blockSize < mb || blockSize&(blockSize-1) != 0 || logicalSectorSize == 0 {
+		return nil, fmt.Errorf("vhdx: bad block size %d", blockSize)
+	}
+
+	v := &vhdxReader{r: r, chunkRatio: (1 << 23) * logicalSectorSize / blockSize}
+	raw = make([]byte, batRegion.Length)
+	if err := readFull(r, raw, int64(batRegion.FileOffset)); err != nil {
+		return nil, fmt.Errorf("vhdx: can't read block allocation table: %v", err)
+	}
+	v.bat = make([]uint64, len(raw)/8)
+	for i := range v.bat {
+		v.bat[i] = binary.LittleEndian.Uint64(raw[i*8:])
+	}
+
+	return &blockDisk{size: size, blockSize: blockSize, readBlock: v.readBlock}, nil
+}
+
+func readVhdxMetadata(r io.ReaderAt, region *vhdxRegionTableEntry) (map[[16]byte][]byte, error) {
+	raw := make([]byte, region.Length)
+	if err := readFull(r, raw, int64(region.FileOffset)); err != nil {
+		return nil, err
+	}
+	rr := bytes.NewReader(raw)
+	var header vhdxMetadataTableHeader
+	if err := binary.Read(rr, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if string(header.Signature[:]) != vhdxMetadataSignature {
+		return nil, errors.New("vhdx: bad metadata signature")
+	}
+	items := map[[16]byte][]byte{}
+	for i := uint16(0); i < header.EntryCount; i++ {
+		var entry vhdxMetadataTableEntry
+		if err := binary.Read(rr, binary.LittleEndian, &entry); err != nil {
+			return nil, err
+		}
+		end := uint64(entry.Offset) + uint64(entry.Length)
+		if end > uint64(len(raw)) {
+			return nil, errors.New("vhdx: bad metadata entry")
+		}
+		items[entry.ItemId] = raw[entry.Offset:end]
+	}
+	return items, nil
+}
+
+func (v *vhdxReader) readBlock(index int64, buf []byte, off int64) error {
+	// a sector bitmap entry follows every chunkRatio payload blocks.
+	batIndex := index + index/v.chunkRatio
+	if batIndex >= int64(len(v.bat)) {
+		zeros(buf)
+		return nil
+	}
+	entry := v.bat[batIndex]
+	switch entry & vhdxBlockStateMask {
+	case vhdxBlockFullyPresent, vhdxBlockPartial:
+		return readFull(v.r, buf, int64(entry>>20)*mb+off)
+	default:
+		// not present, zero or unmapped blocks
+		zeros(buf)
+		return nil
+	}
+}
+
+// writeVhdx writes a dynamic disk:
+//
+//	file identifier | headers | region tables | log | metadata | block allocation table | blocks
+func writeVhdx(dst *os.File, src io.Reader, size int64) error {
+	size = roundUp(size, vhdxLogicalSectorSize)
+	chunkRatio := int64((1 << 23) * vhdxLogicalSectorSize / vhdxBlockSize)
+	blocks := divRoundUp(size, vhdxBlockSize)
+	batEntries := blocks + (blocks-1)/chunkRatio
+	batSize := roundUp(batEntries*8, mb)
+	bat := make([]byte, batSize)
+
+	next := int64(vhdxBatOffset) + batSize
+	source := newBlockSource(src, size, vhdxBlockSize)
+	for {
+		index, data, err := source.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		if _, err := dst.WriteAt(data, next); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(bat[(index+index/chunkRatio)*8:], uint64(next/mb)<<20|vhdxBlockFullyPresent)
+		next += vhdxBlockSize
+	}
+	if _, err := dst.WriteAt(bat, vhdxBatOffset); err != nil {
+		return err
+	}
+
+	if err := writeVhdxMetadata(dst, size); err != nil {
+		return err
+	}
+
+	identifier := littleEndian([]byte(vhdxSignature), utf16.Encode([]rune("packer-plugin-arm-image")))
+	if _, err := dst.WriteAt(identifier, 0); err != nil {
+		return err
+	}
+
+	header := vhdxHeader{
+		FileWriteGuid: newGUID(),
+		DataWriteGuid: newGUID(),
+		Version:       1,
+		LogLength:     vhdxLogSize,
+		LogOffset:     vhdxLogOffset,
+	}
+	copy(header.Signature[:], vhdxHeaderSignature)
+	for i := int64(0); i < 2; i++ {
+		header.SequenceNumber = uint64(i)
+		if err := writeVhdxStruct(dst, vhdxHeaderOffset*(i+1), vhdxHeaderSize, &header); err != nil {
+			return err
+		}
+	}
+
+	regions := []interface{}{
+		&vhdxRegionTableHeader{EntryCount: 2},
+		&vhdxRegionTableEntry{Guid: vhdxBatRegion, FileOffset: vhdxBatOffset, Length: uint32(batSize), Required: vhdxRegionRequired},
+		&vhdxRegionTableEntry{Guid: vhdxMetadataRegion, FileOffset: vhdxMetadataOffset, Length: vhdxMetadataSize, Required: vhdxRegionRequired},
+	}
+	copy(regions[0].(*vhdxRegionTableHeader).Signature[:], vhdxRegionSignature)
+	for i := int64(0); i < 2; i++ {
+		if err := writeVhdxStruct(dst, vhdxRegionTableOffset+i*vhdxRegionTableSize, vhdxRegionTableSize, regions...); err != nil {
+			return err
+		}
+	}
+
+	return dst.Truncate(next)
+}
+
+func writeVhdxMetadata(dst *os.File, size int64) error {
+	type item struct {
+		id    [16]byte
+		flags uint32
+		data  []byte
+	}
+	diskID := newGUID()
+	items := []item{
+		{vhdxItemFileParameters, vhdxMetadataIsRequired, littleEndian(uint32(vhdxBlockSize), uint32(0))},
+		{vhdxItemVirtualDiskSize, vhdxMetadataIsVirtual | vhdxMetadataIsRequired, littleEndian(uint64(size))},
+		{vhdxItemVirtualDiskID, vhdxMetadataIsVirtual | vhdxMetadataIsRequired, diskID[:]},
+		{vhdxItemLogicalSectorSize, vhdxMetadataIsVirtual | vhdxMetadataIsRequired, littleEndian(uint32(vhdxLogicalSectorSize))},
+		{vhdxItemPhysicalSectorSize, vhdxMetadataIsVirtual | vhdxMetadataIsRequired, littleEndian(uint32(vhdxPhysicalSectorSize))},
+	}
+
+	var table, data bytes.Buffer
+	header := vhdxMetadataTableHeader{EntryCount: uint16(len(items))}
+	copy(header.Signature[:], vhdxMetadataSignature)
+	binary.Write(&table, binary.LittleEndian, &header)
+	for _, it := range items {
+		entry := vhdxMetadataTableEntry{
+			ItemId: it.id,
+			Offset: uint32(vhdxMetadataItemOffset + data.Len()),
+			Length: uint32(len(it.data)),
+			Flags:  it.flags,
+		}
+		binary.Write(&table, binary.LittleEndian, &entry)
+		data.Write(it.data)
+	}
+
+	if _, err := dst.WriteAt(table.Bytes(), vhdxMetadataOffset); err != nil {
+		return err
+	}
+	_, err := dst.WriteAt(data.Bytes(), vhdxMetadataOffset+vhdxMetadataItemOffset)
+	return err
+}
+
+// writeVhdxStruct writes the structures in a block of size bytes at off, with its checksum.
+func writeVhdxStruct(dst *os.File, off, size int64, v ...interface{}) error {
+	raw := make([]byte, size)
+	copy(raw, littleEndian(v...))
+	binary.LittleEndian.PutUint32(raw[4:], vhdxChecksum(raw))
+	_, err := dst.WriteAt(raw, off)
+	return err
+}
+
+func littleEndian(v ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, s := range v {
+		binary.Write(&buf, binary.LittleEndian, s)
+	}
+	return buf.Bytes()
+}
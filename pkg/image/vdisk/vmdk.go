@@ -0,0 +1,291 @@
+package vdisk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+)
+
+// See the "Virtual Disk Format 5.0" specification from VMware. Only hosted sparse extents
+// (monolithicSparse and streamOptimized) are supported.
+
+const (
+	vmdkMagic = "KDMV"
+
+	vmdkFlagNewlineTest     = 1 << 0
+	vmdkFlagRedundantGT     = 1 << 1
+	vmdkFlagCompressed      = 1 << 16
+	vmdkGDAtEnd             = 0xffffffffffffffff
+	vmdkGrainSize           = 128
+	vmdkGTEsPerGT           = 512
+	vmdkDescriptorSize      = 20
+	vmdkCompressedMarkerLen = 12
+)
+
+type vmdkHeader struct {
+	Magic              [4]byte
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RgdOffset          uint64
+	GdOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+	Pad                [433]byte
+}
+
+func readVmdkHeader(r io.ReaderAt, off int64) (*vmdkHeader, error) {
+	raw := make([]byte, SectorSize)
+	if err := readFull(r, raw, off); err != nil {
+		return nil, err
+	}
+	var h vmdkHeader
+	if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	if string(h.Magic[:]) != vmdkMagic {
+		return nil, errors.New("vmdk: bad header magic")
+	}
+	return &h, nil
+}
+
+type vmdkReader struct {
+	r         io.ReaderAt
+	header    *vmdkHeader
+	grainSize int64
+	gd        []uint32
+
+	gtIndex int
+	gt      []uint32
+
+	// the last compressed grain that was read
+	cachedIndex int64
+	cachedGrain []byte
+}
+
+func openVmdk(r io.ReaderAt, fileSize int64) (Disk, error) {
+	h, err := readVmdkHeader(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if h.GdOffset == vmdkGDAtEnd {
+		// streamOptimized images written in one pass have the real header in the footer,
+		// which is followed by the end-of-stream marker.
+		h, err = readVmdkHeader(r, fileSize-2*SectorSize)
+		if err != nil {
+			return nil, fmt.Errorf("vmdk: can't read footer: %v", err)
+		}
+	}
+	if h.GrainSize == 0 || h.NumGTEsPerGT == 0 {
+		return nil, errors.New("vmdk: bad grain size")
+	}
+
+	v := &vmdkReader{r: r, header: h, grainSize: int64(h.GrainSize) * SectorSize, gtIndex: -1, cachedIndex: -1}
+	grains := divRoundUp(int64(h.Capacity), int64(h.GrainSize))
+	gdEntries := divRoundUp(grains, int64(h.NumGTEsPerGT))
+	raw := make([]byte, gdEntries*4)
+	if err := readFull(r, raw, int64(h.GdOffset)*SectorSize); err != nil {
+		return nil, fmt.Errorf("vmdk: can't read grain directory: %v", err)
+	}
+	v.gd = make([]uint32, gdEntries)
+	for i := range v.gd {
+		v.gd[i] = binary.LittleEndian.Uint32(raw[i*4:])
+	}
+
+	return &blockDisk{size: int64(h.Capacity) * SectorSize, blockSize: v.grainSize, readBlock: v.readGrain}, nil
+}
+
+func (v *vmdkReader) gtEntry(grain int64) (uint32, error) {
+	gtEntries := int64(v.header.NumGTEsPerGT)
+	gdIndex := int(grain / gtEntries)
+	if gdIndex != v.gtIndex {
+		if v.gd[gdIndex] == 0 {
+			return 0, nil
+		}
+		raw := make([]byte, gtEntries*4)
+		if err := readFull(v.r, raw, int64(v.gd[gdIndex])*SectorSize); err != nil {
+			return 0, fmt.Errorf("vmdk: can't read grain table: %v", err)
+		}
+		v.gt = make([]uint32, gtEntries)
+		for i := range v.gt {
+			v.gt[i] = binary.LittleEndian.Uint32(raw[i*4:])
+		}
+		v.gtIndex = gdIndex
+	}
+	return v.gt[grain%gtEntries], nil
+}
+
+func (v *vmdkReader) readGrain(grain int64, buf []byte, off int64) error {
+	entry, err := v.gtEntry(grain)
+	if err != nil {
+		return err
+	}
+	// 1 is used for zeroed grains.
+	if entry <= 1 {
+		zeros(buf)
+		return nil
+	}
+	if v.header.Flags&vmdkFlagCompressed == 0 {
+		return readFull(v.r, buf, int64(entry)*SectorSize+off)
+	}
+
+	if v.cachedIndex != grain {
+		if err := v.decompress(entry); err != nil {
+			return err
+		}
+		v.cachedIndex = grain
+	}
+	copy(buf, v.cachedGrain[off:])
+	return nil
+}
+
+// decompress reads a compressed grain, that starts with a marker holding its lba and size.
+func (v *vmdkReader) decompress(entry uint32) error {
+	offset := int64(entry) * SectorSize
+	marker := make([]byte, vmdkCompressedMarkerLen)
+	if err := readFull(v.r, marker, offset); err != nil {
+		return err
+	}
+	compressed := make([]byte, binary.LittleEndian.Uint32(marker[8:]))
+	if err := readFull(v.r, compressed, offset+vmdkCompressedMarkerLen); err != nil {
+		return err
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return fmt.Errorf("vmdk: can't decompress grain: %v", err)
+	}
+	if v.cachedGrain == nil {
+		v.cachedGrain = make([]byte, v.grainSize)
+	}
+	n, err := io.ReadFull(zr, v.cachedGrain)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("vmdk: can't decompress grain: %v", err)
+	}
+	zeros(v.cachedGrain[n:])
+	return nil
+}
+
+// writeVmdk writes a monolithicSparse image, with the same layout as the one used by VMware:
+//
+//	header | descriptor | redundant grain directory and tables | grain directory and tables | grains
+func writeVmdk(dst *os.File, src io.Reader, size int64) error {
+	const grainBytes = vmdkGrainSize * SectorSize
+
+	capacity := divRoundUp(size, SectorSize)
+	grains := divRoundUp(capacity, vmdkGrainSize)
+	gdEntries := divRoundUp(grains, vmdkGTEsPerGT)
+	gdSectors := divRoundUp(gdEntries*4, SectorSize)
+	gtSectors := int64(vmdkGTEsPerGT * 4 / SectorSize)
+
+	rgdOffset := int64(1 + vmdkDescriptorSize)
+	gdOffset := rgdOffset + gdSectors + gdEntries*gtSectors
+	overHead := roundUp(gdOffset+gdSectors+gdEntries*gtSectors, vmdkGrainSize)
+
+	gt := make([]uint32, gdEntries*vmdkGTEsPerGT)
+	next := overHead
+	blocks := newBlockSource(src, capacity*SectorSize, grainBytes)
+	for {
+		index, data, err := blocks.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		if _, err := dst.WriteAt(data, next*SectorSize); err != nil {
+			return err
+		}
+		gt[index] = uint32(next)
+		next += vmdkGrainSize
+	}
+
+	// the redundant copy is identical, except for the location of the tables.
+	for _, offset := range []int64{rgdOffset, gdOffset} {
+		gd := make([]byte, gdSectors*SectorSize)
+		tables := make([]byte, gdEntries*gtSectors*SectorSize)
+		for i := int64(0); i < gdEntries; i++ {
+			binary.LittleEndian.PutUint32(gd[i*4:], uint32(offset+gdSectors+i*gtSectors))
+		}
+		for i, entry := range gt {
+			binary.LittleEndian.PutUint32(tables[i*4:], entry)
+		}
+		if _, err := dst.WriteAt(append(gd, tables...), offset*SectorSize); err != nil {
+			return err
+		}
+	}
+
+	descriptor := vmdkDescriptor(filepath.Base(dst.Name()), capacity)
+	if len(descriptor) > vmdkDescriptorSize*SectorSize {
+		return errors.New("vmdk: descriptor is too big")
+	}
+	if _, err := dst.WriteAt([]byte(descriptor), SectorSize); err != nil {
+		return err
+	}
+
+	header := vmdkHeader{
+		Version:            1,
+		Flags:              vmdkFlagNewlineTest | vmdkFlagRedundantGT,
+		Capacity:           uint64(capacity),
+		GrainSize:          vmdkGrainSize,
+		DescriptorOffset:   1,
+		DescriptorSize:     vmdkDescriptorSize,
+		NumGTEsPerGT:       vmdkGTEsPerGT,
+		RgdOffset:          uint64(rgdOffset),
+		GdOffset:           uint64(gdOffset),
+		OverHead:           uint64(overHead),
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+	}
+	copy(header.Magic[:], vmdkMagic)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &header)
+	if _, err := dst.WriteAt(buf.Bytes(), 0); err != nil {
+		return err
+	}
+	return dst.Truncate(next * SectorSize)
+}
+
+func vmdkDescriptor(extent string, capacity int64) string {
+	cylinders := capacity / (16 * 63)
+	if cylinders > 16383 {
+		cylinders = 16383
+	}
+	return fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=%08x
+parentCID=ffffffff
+createType="monolithicSparse"
+
+# Extent description
+RW %d SPARSE "%s"
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "16"
+ddb.geometry.sectors = "63"
+ddb.adapterType = "ide"
+`, rand.Uint32(), capacity, extent, cylinders)
+}
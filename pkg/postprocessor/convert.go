@@ -0,0 +1,128 @@
+//go:generate go run github.com/hashicorp/packer-plugin-sdk/cmd/packer-sdc struct-markdown
+//go:generate go run github.com/hashicorp/packer-plugin-sdk/cmd/packer-sdc mapstructure-to-hcl2 -type ConvertConfig
+
+package postprocessor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/hashicorp/packer-plugin-sdk/packer"
+	"github.com/hashicorp/packer-plugin-sdk/template/config"
+	"github.com/hashicorp/packer-plugin-sdk/template/interpolate"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image"
+	"github.com/solo-io/packer-plugin-arm-image/pkg/image/vdisk"
+)
+
+const ConvertId = "solo-io.arm-image.convert"
+
+type ConvertConfig struct {
+	// Format of the converted image: `qcow2`, `vmdk`, `vhd` or `vhdx`.
+	Format string `mapstructure:"format" required:"true"`
+	// Path of the converted image. Defaults to the path of the input image, with the format as extension.
+	Output string `mapstructure:"output"`
+}
+
+type Converter struct {
+	config ConvertConfig
+}
+
+func NewConverter() packer.PostProcessor {
+	return &Converter{}
+}
+
+func (c *Converter) ConfigSpec() hcldec.ObjectSpec {
+	return c.config.FlatMapstructure().HCL2Spec()
+}
+
+func (c *Converter) Configure(cfgs ...interface{}) error {
+	err := config.Decode(&c.config, &config.DecodeOpts{
+		Interpolate:       true,
+		InterpolateFilter: &interpolate.RenderFilter{},
+	}, cfgs...)
+	if err != nil {
+		return err
+	}
+
+	for _, format := range vdisk.Formats {
+		if c.config.Format == string(format) {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown format %q, supported formats are %v", c.config.Format, vdisk.Formats)
+}
+
+func (c *Converter) PostProcess(ctx context.Context, ui packer.Ui, ain packer.Artifact) (a packer.Artifact, keep bool, forceOverride bool, err error) {
+	inputfiles := ain.Files()
+	if len(inputfiles) != 1 {
+		return nil, false, false, errors.New("ambiguous images")
+	}
+	input := inputfiles[0]
+	format := vdisk.Format(c.config.Format)
+
+	output := c.config.Output
+	if output == "" {
+		output = strings.TrimSuffix(input, filepath.Ext(input)) + "." + c.config.Format
+	}
+
+	img, err := image.NewImageOpener(ui).Open(input)
+	if err != nil {
+		return nil, false, false, err
+	}
+	defer img.Close()
+	size := int64(img.SizeEstimate())
+	if size == 0 {
+		return nil, false, false, fmt.Errorf("can't determine the size of %s", input)
+	}
+
+	f, err := os.OpenFile(output, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, false, false, err
+	}
+	defer f.Close()
+
+	ui.Say(fmt.Sprintf("Converting %s to %s image %s", input, format, output))
+	if err := vdisk.Write(f, img, size, format); err != nil {
+		os.Remove(output)
+		return nil, false, false, err
+	}
+
+	return &ConvertArtifact{path: output, format: format, input: ain}, false, false, nil
+}
+
+// ConvertArtifact is the converted image. It forwards the state of the input artifact (e.g. the
+// generated data of the builder) so that later post-processors can use it.
+type ConvertArtifact struct {
+	path   string
+	format vdisk.Format
+	input  packer.Artifact
+}
+
+func (a *ConvertArtifact) BuilderId() string {
+	return ConvertId
+}
+
+func (a *ConvertArtifact) Files() []string {
+	return []string{a.path}
+}
+
+func (a *ConvertArtifact) Id() string {
+	return string(a.format)
+}
+
+func (a *ConvertArtifact) String() string {
+	return fmt.Sprintf("%s image: %s", a.format, a.path)
+}
+
+func (a *ConvertArtifact) State(name string) interface{} {
+	return a.input.State(name)
+}
+
+func (a *ConvertArtifact) Destroy() error {
+	return os.Remove(a.path)
+}
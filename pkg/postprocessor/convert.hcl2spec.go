@@ -0,0 +1,33 @@
+// Code generated by "packer-sdc mapstructure-to-hcl2"; DO NOT EDIT.
+
+package postprocessor
+
+import (
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// FlatConvertConfig is an auto-generated flat version of ConvertConfig.
+// Where the contents of a field with a `mapstructure:,squash` tag are bubbled up.
+type FlatConvertConfig struct {
+	Format *string `mapstructure:"format" required:"true" cty:"format" hcl:"format"`
+	Output *string `mapstructure:"output" cty:"output" hcl:"output"`
+}
+
+// FlatMapstructure returns a new FlatConvertConfig.
+// FlatConvertConfig is an auto-generated flat version of ConvertConfig.
+// Where the contents a fields with a `mapstructure:,squash` tag are bubbled up.
+func (*ConvertConfig) FlatMapstructure() interface{ HCL2Spec() map[string]hcldec.Spec } {
+	return new(FlatConvertConfig)
+}
+
+// HCL2Spec returns the hcl spec of a ConvertConfig.
+// This spec is used by HCL to read the fields of ConvertConfig.
+// The decoded values from this spec will then be applied to a FlatConvertConfig.
+func (*FlatConvertConfig) HCL2Spec() map[string]hcldec.Spec {
+	s := map[string]hcldec.Spec{
+		"format": &hcldec.AttrSpec{Name: "format", Type: cty.String, Required: false},
+		"output": &hcldec.AttrSpec{Name: "output", Type: cty.String, Required: false},
+	}
+	return s
+}
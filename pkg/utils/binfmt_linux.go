@@ -0,0 +1,21 @@
+package utils
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// BinfmtFixBinarySupported returns whether binfmt_misc supports the F (fix binary) flag, that
+// linux supports since 4.8.
+func BinfmtFixBinarySupported() bool {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return false
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(unix.ByteSliceToString(uts.Release[:]), "%d.%d", &major, &minor); err != nil {
+		return false
+	}
+	return major > 4 || major == 4 && minor >= 8
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package utils
+
+// BinfmtFixBinarySupported is only supported on linux.
+func BinfmtFixBinarySupported() bool {
+	return false
+}
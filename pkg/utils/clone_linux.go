@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// CloneFile copies src to dst, which should be empty. If the filesystem supports it, the data
+// is shared with a reflink. Otherwise, only the data segments of src are copied with
+// copy_file_range, so holes in src stay holes in dst.
+// If an error is returned, dst may be partially written.
+func CloneFile(dst, src *os.File) error {
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err == nil {
+		return nil
+	}
+
+	finfo, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	size := finfo.Size()
+
+	srcfd, dstfd := int(src.Fd()), int(dst.Fd())
+	for offset := int64(0); offset < size; {
+		data, err := unix.Seek(srcfd, offset, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			// no more data, only a hole until the end of the file.
+			break
+		} else if err != nil {
+			return err
+		}
+		hole, err := unix.Seek(srcfd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return err
+		}
+
+		roff, woff := data, data
+		for roff < hole {
+			n, err := unix.CopyFileRange(srcfd, &roff, dstfd, &woff, int(hole-roff), 0)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return io.ErrUnexpectedEOF
+			}
+		}
+		offset = hole
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return dst.Truncate(size)
+}
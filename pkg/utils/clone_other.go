@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package utils
+
+import (
+	"errors"
+	"os"
+)
+
+// CloneFile is only supported on linux.
+func CloneFile(dst, src *os.File) error {
+	return errors.New("cloning files is not supported on this platform")
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package utils
+
+import "errors"
+
+// FreeSpace is only supported on linux.
+func FreeSpace(dir string) (uint64, error) {
+	return 0, errors.New("checking free space is not supported on this platform")
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package utils
+
+import (
+	"errors"
+	"os"
+)
+
+// LockFile is only supported on linux.
+func LockFile(f *os.File) error {
+	return errors.New("locking files is not supported on this platform")
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"bytes"
+	"os"
+)
+
+const sparseBlockSize = 4096
+
+var zeroBlock = make([]byte, sparseBlockSize)
+
+// SparseWriter writes to a file, skipping over blocks that are all zeros instead of writing them.
+// The file should be empty (or new) so the skipped blocks read as zeros.
+// Finish must be called when done writing, so the file has the correct size if it ends with zeros.
+type SparseWriter struct {
+	f      *os.File
+	offset int64
+}
+
+func NewSparseWriter(f *os.File) *SparseWriter {
+	return &SparseWriter{f: f}
+}
+
+func (w *SparseWriter) Write(p []byte) (int, error) {
+	// start of a run of non-zero blocks that is not yet written
+	runStart := 0
+	for pos := 0; pos < len(p); {
+		// align the blocks to the file offset, so holes are aligned with the filesystem blocks.
+		n := sparseBlockSize - int((w.offset+int64(pos))%sparseBlockSize)
+		if n > len(p)-pos {
+			n = len(p) - pos
+		}
+		if bytes.Equal(p[pos:pos+n], zeroBlock[:n]) {
+			if runStart < pos {
+				if _, err := w.f.WriteAt(p[runStart:pos], w.offset+int64(runStart)); err != nil {
+					return runStart, err
+				}
+			}
+			runStart = pos + n
+		}
+		pos += n
+	}
+	if runStart < len(p) {
+		if _, err := w.f.WriteAt(p[runStart:], w.offset+int64(runStart)); err != nil {
+			return runStart, err
+		}
+	}
+	w.offset += int64(len(p))
+	return len(p), nil
+}
+
+// Finish sets the size of the file to the amount of data written.
+func (w *SparseWriter) Finish() error {
+	return w.f.Truncate(w.offset)
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func tempFile(t *testing.T) *os.File {
+	f, err := ioutil.TempFile("", "sparse-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+		os.Remove(f.Name())
+	})
+	return f
+}
+
+func sparseTestData() []byte {
+	data := make([]byte, 1<<20)
+	copy(data[100:], "some data")
+	copy(data[sparseBlockSize*10:], "more data")
+	// data that crosses a block boundary
+	copy(data[sparseBlockSize*20-3:], "boundary")
+	return data
+}
+
+func TestSparseWriter(t *testing.T) {
+	data := sparseTestData()
+	// zeros at the end, the file must still be of the right size
+	data = append(data, make([]byte, 3*sparseBlockSize+5)...)
+
+	f := tempFile(t)
+	w := NewSparseWriter(f)
+	// odd sized writes, that are not aligned to the blocks
+	if _, err := io.CopyBuffer(w, bytes.NewReader(data), make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, data) {
+		t.Errorf("written data differs from source data")
+	}
+}
+
+func TestCloneFile(t *testing.T) {
+	data := sparseTestData()
+
+	src := tempFile(t)
+	w := NewSparseWriter(src)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := tempFile(t)
+	if err := CloneFile(dst, src); err != nil {
+		t.Skipf("cloning not supported: %v", err)
+	}
+
+	cloned, err := ioutil.ReadFile(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cloned, data) {
+		t.Errorf("cloned data differs from source data")
+	}
+}